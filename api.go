@@ -18,16 +18,20 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
+	"strings"
 
 	"go.uber.org/zap"
 
+	traceapi "cloud.google.com/go/trace/apiv2"
 	"contrib.go.opencensus.io/exporter/stackdriver"
 	"contrib.go.opencensus.io/exporter/zipkin"
 	openzipkin "github.com/openzipkin/zipkin-go"
 	zipkinHTTP "github.com/openzipkin/zipkin-go/reporter/http"
 	"go.opencensus.io/trace"
+	"golang.org/x/oauth2/google"
 )
 
 type TraceAttributes map[string]interface{}
@@ -43,7 +47,7 @@ func init() {
 func GetTraceID(ctx context.Context) (out trace.TraceID) {
 	span := trace.FromContext(ctx)
 	if span == nil {
-		return config.Load().(*defaultIDGenerator).NewTraceID()
+		return getIDGenerator().NewTraceID()
 	}
 
 	out = span.SpanContext().TraceID
@@ -61,9 +65,9 @@ func GetTraceIDOrEmpty(ctx context.Context) (out trace.TraceID) {
 	return
 }
 
-// NewRandomTraceID returns a random trace ID using OpenCensus default config IDGenerator.
+// NewRandomTraceID returns a random trace ID using the current `IDGenerator`, see `SetIDGenerator`.
 func NewRandomTraceID() trace.TraceID {
-	return config.Load().(*defaultIDGenerator).NewTraceID()
+	return getIDGenerator().NewTraceID()
 }
 
 // NewZeroedTraceID returns a mocked, fixed trace ID containing only 0s.
@@ -100,7 +104,7 @@ func NewFixedTraceID(hexTraceID string) (out trace.TraceID) {
 func NewZeroedTraceIDInContext(ctx context.Context) context.Context {
 	ctx, _ = trace.StartSpanWithRemoteParent(ctx, "zeroed", trace.SpanContext{
 		TraceID: NewZeroedTraceID(),
-		SpanID:  config.Load().(*defaultIDGenerator).NewSpanID(),
+		SpanID:  getIDGenerator().NewSpanID(),
 	})
 
 	return ctx
@@ -115,7 +119,7 @@ func NewZeroedTraceIDInContext(ctx context.Context) context.Context {
 func NewFixedTraceIDInContext(ctx context.Context, hexTraceID string) context.Context {
 	ctx, _ = trace.StartSpanWithRemoteParent(ctx, "fixed", trace.SpanContext{
 		TraceID: NewFixedTraceID(hexTraceID),
-		SpanID:  config.Load().(*defaultIDGenerator).NewSpanID(),
+		SpanID:  getIDGenerator().NewSpanID(),
 	})
 
 	return ctx
@@ -130,32 +134,140 @@ func NewFixedTraceIDInContext(ctx context.Context, hexTraceID string) context.Co
 // which corresponds to `hostname` resolution.
 //
 // In development, registers exporters based on environment variables
-// "TRACING_ZAP_EXPORTER" (zap exporter) and `TRACING_ZIPKIN_EXPORTER=zipkinURL`
-// for Zipkin exporter.
+// "TRACING_ZAP_EXPORTER" (zap exporter), `TRACING_ZIPKIN_EXPORTER=zipkinURL`
+// for Zipkin exporter, `TRACING_JAEGER_EXPORTER=endpoint` for Jaeger exporter,
+// `TRACING_OTLP_EXPORTER=endpoint` for OTLP exporter and `TRACING_FILE_EXPORTER=path`
+// for file exporter.
 //
-// Options:
-// - A `trace.Sampler` instance: sets `trace` default config `DefaultSampler` value to this value (defaults `1/4.0`)
-// - A `dtracing.TraceAttributes` instance: sets additional StackDriver default attributes (defaults to `nil`)
-func SetupTracing(serviceName string, options ...interface{}) error {
-	sampler := samplerOptionOrDefault(options, trace.ProbabilitySampler(1/4.0))
-	defaultAttributes := traceAttributesOptionOrDefault(options, nil)
-
-	if IsProductionEnvironment() {
+// The returned ShutdownFunc flushes and unregisters every exporter registered
+// by this call and restores the global state (sampler, ID generator, ...) it
+// changed, it should be invoked before the process exits so that the last spans
+// are not lost. When an error is returned, the global state is left untouched.
+//
+// Options are typed `Option` values (see `WithSampler`, `WithDefaultAttributes`,
+// `WithExporter`, `WithEnvironment`, `WithPropagation`, `WithIDGenerator`,
+// `WithSpanLimits` and `WithSamplingRules`). For
+// backward compatibility, the following raw values are also accepted:
+// - A `trace.Sampler` instance: equivalent to `WithSampler(sampler)`
+// - A `dtracing.TraceAttributes` instance: equivalent to `WithDefaultAttributes(attributes)`
+//
+// Any other value results in an error, prefer `Setup` in new code so options
+// are checked at compile time.
+func SetupTracing(serviceName string, options ...interface{}) (ShutdownFunc, error) {
+	typedOptions, err := legacyOptionsToOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return Setup(serviceName, typedOptions...)
+}
+
+// Setup is exactly like `SetupTracing` but accepts only typed options.
+func Setup(serviceName string, options ...Option) (ShutdownFunc, error) {
+	config, err := newSetupConfig(options)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options: %s", err)
+	}
+
+	wrapExporter := func(exporter trace.Exporter) trace.Exporter { return exporter }
+	if config.spanLimits != nil {
+		// Limits were validated with the options, data added directly on spans is
+		// limited on export
+		limits := *config.spanLimits
+		wrapExporter = func(exporter trace.Exporter) trace.Exporter {
+			return &SpanLimitingExporter{inner: exporter, limits: limits.withDefaults()}
+		}
+	}
+
+	// Exporters are created first so that the global state is left untouched when
+	// they fail, the previous state being restored on shutdown
+	previousSampler := getDefaultSampler()
+
+	var shutdown ShutdownFunc
+	if config.isProduction() {
 		zlog.Info("registering StackDriver exporter")
-		return RegisterStackDriverExporter(serviceName, sampler, stackdriver.Options{
-			DefaultTraceAttributes: defaultAttributes,
-		})
+		shutdown, err = registerStackDriverExporter(serviceName, config.sampler, stackdriver.Options{
+			ProjectID:              config.projectID,
+			DefaultTraceAttributes: config.defaultAttributes,
+		}, wrapExporter)
+	} else {
+		zlog.Info("registering development exporters from environment variables")
+		shutdown, err = registerDevelopmentExportersFromEnv(serviceName, config.sampler, wrapExporter)
 	}
 
-	zlog.Info("registering development exporters from environment variables")
-	return RegisterDevelopmentExportersFromEnv(serviceName, sampler)
+	if err != nil {
+		SetDefaultSampler(previousSampler)
+		return nil, err
+	}
+
+	shutdowns := []ShutdownFunc{newShutdownFunc(applySetupState(config, previousSampler)), shutdown}
+	for _, exporter := range config.exporters {
+		shutdowns = append(shutdowns, registerExporter(wrapExporter(exporter)))
+	}
+
+	return joinShutdowns(shutdowns...), nil
+}
+
+// applySetupState applies the global state configured by `config` and returns a
+// function restoring the previous one. Sampling rules are cleared rather than
+// restored, since they can only come from a previous setup.
+func applySetupState(config *setupConfig, previousSampler trace.Sampler) (restore func() error) {
+	previousIDGenerator := getIDGenerator()
+	previousFormat := getDefaultFormat()
+	previousSpanLimits := currentSpanLimits.Load().(SpanLimits)
+
+	if config.idGenerator != nil {
+		SetIDGenerator(config.idGenerator)
+	}
+
+	if config.propagation != nil {
+		setDefaultFormat(config.propagation)
+	}
+
+	// Also clears rules left by a previous setup when none are configured
+	SetDefaultSamplingRules(config.samplingRules)
+
+	if config.spanLimits != nil {
+		// Already validated with the options
+		SetSpanLimits(*config.spanLimits)
+	}
+
+	return func() error {
+		if config.samplingRules != nil {
+			clearDefaultSamplingRules(config.samplingRules)
+		}
+
+		if config.spanLimits != nil {
+			SetSpanLimits(previousSpanLimits)
+		}
+
+		if config.propagation != nil {
+			setDefaultFormat(previousFormat)
+		}
+
+		if config.idGenerator != nil {
+			SetIDGenerator(previousIDGenerator)
+		}
+
+		SetDefaultSampler(previousSampler)
+		return nil
+	}
 }
 
 // RegisterStackDriverExporter registers the production `StackDriver` exporter
 // for all traces. Uses the `sampler` as the default sampler for all traces.
 // The service name is also added a a label to all traces created.
-func RegisterStackDriverExporter(serviceName string, sampler trace.Sampler, options stackdriver.Options) error {
-	trace.ApplyConfig(trace.Config{DefaultSampler: sampler})
+//
+// The returned ShutdownFunc flushes pending spans, closes the exporter's client
+// connections and unregisters it.
+func RegisterStackDriverExporter(serviceName string, sampler trace.Sampler, options stackdriver.Options) (ShutdownFunc, error) {
+	return registerStackDriverExporter(serviceName, sampler, options, nil)
+}
+
+// registerStackDriverExporter is `RegisterStackDriverExporter` registering the exporter
+// wrapped by `wrap`, if not nil.
+func registerStackDriverExporter(serviceName string, sampler trace.Sampler, options stackdriver.Options, wrap func(trace.Exporter) trace.Exporter) (ShutdownFunc, error) {
+	SetDefaultSampler(sampler)
 
 	if options.DefaultTraceAttributes == nil {
 		options.DefaultTraceAttributes = map[string]interface{}{}
@@ -164,68 +276,238 @@ func RegisterStackDriverExporter(serviceName string, sampler trace.Sampler, opti
 	options.DefaultTraceAttributes["serviceName"] = serviceName
 	options.DefaultTraceAttributes["pod"] = hostname
 
-	zlog.Info("creating StackDriver exporter", zap.Any("default_attributes", options.DefaultTraceAttributes))
+	// Resolved here rather than by the exporter, which does not expose it, so that
+	// the StackDriver log fields format can link logs to their trace
+	projectID, err := resolveStackDriverProjectID(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create StackDriver exporter: %s", err)
+	}
+	options.ProjectID = projectID
+
+	zlog.Info("creating StackDriver exporter", zap.String("project_id", projectID), zap.Any("default_attributes", options.DefaultTraceAttributes))
 
 	exporter, err := stackdriver.NewExporter(options)
 	if err != nil {
-		return fmt.Errorf("failed to create StackDriver exporter: %s", err)
+		return nil, fmt.Errorf("failed to create StackDriver exporter: %s", err)
+	}
+
+	SetLogFieldsProjectID(projectID)
+
+	if wrap != nil {
+		return registerExporter(wrap(exporter)), nil
 	}
 
-	trace.RegisterExporter(exporter)
-	return nil
+	return registerExporter(exporter), nil
+}
+
+var findDefaultCredentials = google.FindDefaultCredentials
+
+// resolveStackDriverProjectID returns the project ID of `options`, or else the one
+// of the application default credentials, like `stackdriver.NewExporter` does.
+func resolveStackDriverProjectID(options stackdriver.Options) (string, error) {
+	if options.ProjectID != "" {
+		return options.ProjectID, nil
+	}
+
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	credentials, err := findDefaultCredentials(ctx, traceapi.DefaultAuthScopes()...)
+	if err != nil {
+		return "", fmt.Errorf("unable to find default credentials: %s", err)
+	}
+
+	if credentials.ProjectID == "" {
+		return "", fmt.Errorf("no project found with application default credentials")
+	}
+
+	return credentials.ProjectID, nil
 }
 
 // RegisterDevelopmentExportersFromEnv registers exporters based on environment
-// variables "TRACING_ZAP_EXPORTER" (zap exporter) and
-// `TRACING_ZIPKIN_EXPORTER=zipkinURL` for Zipkin exporter.
-func RegisterDevelopmentExportersFromEnv(serviceName string, sampler trace.Sampler) error {
-	trace.ApplyConfig(trace.Config{DefaultSampler: sampler})
+// variables "TRACING_ZAP_EXPORTER" (zap exporter, `TRACING_ZAP_EXPORTER=tree` logging
+// whole traces as trees, see `WithZapExporterTreeMode`),
+// `TRACING_ZIPKIN_EXPORTER=zipkinURL` for Zipkin exporter,
+// `TRACING_JAEGER_EXPORTER=endpoint` for Jaeger exporter (see `RegisterJaegerExporter`
+// for the endpoint format), `TRACING_OTLP_EXPORTER=endpoint` for OTLP exporter
+// (see `RegisterOTLPExporter` for the endpoint format) and `TRACING_FILE_EXPORTER=path`
+// for JSON Lines file exporter (gzip compressed if the path ends with `.gz`).
+//
+// Each exporter receives all spans unless a filter expression (see `ParseSpanFilter`)
+// is set in its `TRACING_<NAME>_EXPORTER_FILTER` environment variable, `<NAME>` being
+// one of `ZAP`, `ZIPKIN`, `JAEGER`, `OTLP` or `FILE`. For example,
+// `TRACING_ZAP_EXPORTER_FILTER=status=error` only logs failed spans.
+//
+// The returned ShutdownFunc flushes and unregisters all exporters that were
+// registered.
+func RegisterDevelopmentExportersFromEnv(serviceName string, sampler trace.Sampler) (ShutdownFunc, error) {
+	return registerDevelopmentExportersFromEnv(serviceName, sampler, nil)
+}
+
+// registerDevelopmentExportersFromEnv is `RegisterDevelopmentExportersFromEnv`
+// registering the fan-out exporter wrapped by `wrap`, if not nil.
+func registerDevelopmentExportersFromEnv(serviceName string, sampler trace.Sampler, wrap func(trace.Exporter) trace.Exporter) (ShutdownFunc, error) {
+	SetDefaultSampler(sampler)
 
 	zapExporterEnv := os.Getenv("TRACING_ZAP_EXPORTER")
 	zipkinExporterEnv := os.Getenv("TRACING_ZIPKIN_EXPORTER")
+	jaegerExporterEnv := os.Getenv("TRACING_JAEGER_EXPORTER")
+	otlpExporterEnv := os.Getenv("TRACING_OTLP_EXPORTER")
+	fileExporterEnv := os.Getenv("TRACING_FILE_EXPORTER")
+
+	var routes []FanOutRoute
+	addRoute := func(name string, exporter trace.Exporter) error {
+		route, err := RouteSpansFromEnv(name, exporter)
+		if err != nil {
+			return err
+		}
+
+		routes = append(routes, route)
+		return nil
+	}
+
+	failed := func(exporter trace.Exporter, err error) (ShutdownFunc, error) {
+		if c, ok := exporter.(io.Closer); ok {
+			c.Close()
+		}
+
+		NewFanOutExporter(routes...).Close()
+		return nil, err
+	}
 
 	if zapExporterEnv != "" {
 		zlog.Info("registering zap exporter")
-		RegisterZapExporter()
+		var options []ZapExporterOption
+		if zapExporterEnv == "tree" {
+			// Filtering individual spans would leave holes in the logged trees
+			if os.Getenv("TRACING_ZAP_EXPORTER_FILTER") != "" {
+				return failed(nil, fmt.Errorf("TRACING_ZAP_EXPORTER_FILTER cannot be used with TRACING_ZAP_EXPORTER=tree"))
+			}
+
+			options = append(options, WithZapExporterTreeMode(defaultZapExporterMaxBufferedTraces))
+		}
+
+		exporter := NewZapExporter(zlog, options...)
+		if err := addRoute("zap", exporter); err != nil {
+			return failed(exporter, err)
+		}
 	}
 
 	if zipkinExporterEnv != "" {
 		zlog.Info("registering Zipkin exporter", zap.String("url", zipkinExporterEnv))
-		err := RegisterZipkinExporter(serviceName, zipkinExporterEnv)
+		exporter, err := newZipkinExporter(serviceName, zipkinExporterEnv)
 		if err != nil {
-			return fmt.Errorf("failed to register ZipKin exporter: %s", err)
+			return failed(nil, fmt.Errorf("failed to register ZipKin exporter: %s", err))
+		}
+
+		if err := addRoute("zipkin", exporter); err != nil {
+			return failed(exporter, err)
 		}
 	}
 
-	return nil
+	if jaegerExporterEnv != "" {
+		zlog.Info("registering Jaeger exporter", zap.String("endpoint", jaegerExporterEnv))
+		exporter, err := NewJaegerExporter(serviceName, jaegerExporterEnv)
+		if err != nil {
+			return failed(nil, fmt.Errorf("failed to register Jaeger exporter: %s", err))
+		}
+
+		if err := addRoute("jaeger", exporter); err != nil {
+			return failed(exporter, err)
+		}
+	}
+
+	if otlpExporterEnv != "" {
+		zlog.Info("registering OTLP exporter", zap.String("endpoint", otlpExporterEnv))
+		exporter, err := NewOTLPExporter(serviceName, otlpExporterEnv)
+		if err != nil {
+			return failed(nil, fmt.Errorf("failed to register OTLP exporter: %s", err))
+		}
+
+		if err := addRoute("otlp", exporter); err != nil {
+			return failed(exporter, err)
+		}
+	}
+
+	if fileExporterEnv != "" {
+		zlog.Info("registering file exporter", zap.String("path", fileExporterEnv))
+		var options []FileOption
+		if strings.HasSuffix(fileExporterEnv, ".gz") {
+			options = append(options, WithFileGzip())
+		}
+
+		exporter, err := NewFileExporter(fileExporterEnv, options...)
+		if err != nil {
+			return failed(nil, fmt.Errorf("failed to register file exporter: %s", err))
+		}
+
+		if err := addRoute("file", exporter); err != nil {
+			return failed(exporter, err)
+		}
+	}
+
+	if len(routes) == 0 {
+		return NoopShutdown, nil
+	}
+
+	// A single fan-out exporter is registered so that each exporter only receives the
+	// spans matched by its `TRACING_<NAME>_EXPORTER_FILTER` filter
+	var exporter trace.Exporter = NewFanOutExporter(routes...)
+	if wrap != nil {
+		exporter = wrap(exporter)
+	}
+
+	return registerExporter(exporter), nil
 }
 
 // RegisterZapExporter registers a Zap exporter that exports all traces
-// to zlog instance of this package.
-func RegisterZapExporter() {
-	exporter := new(zapExporter)
-	trace.RegisterExporter(exporter)
+// to zlog instance of this package, see `NewZapExporter`.
+func RegisterZapExporter(options ...ZapExporterOption) ShutdownFunc {
+	return registerExporter(NewZapExporter(zlog, options...))
 }
 
 // RegisterZipkinExporter registers a ZipKin exporter that exports all traces
 // to a zipkin instance pointed by `zipkinURL`. Note the `zipkinURL` must be
 // the full path of the export function.
-func RegisterZipkinExporter(serviceName string, zipkinURL string) error {
+//
+// The returned ShutdownFunc unregisters the exporter and closes the underlying
+// HTTP reporter, sending any buffered spans.
+func RegisterZipkinExporter(serviceName string, zipkinURL string) (ShutdownFunc, error) {
+	exporter, err := newZipkinExporter(serviceName, zipkinURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return registerExporter(exporter), nil
+}
+
+// closingZipkinExporter closes the HTTP reporter, sending any buffered spans, when the
+// exporter is closed.
+type closingZipkinExporter struct {
+	*zipkin.Exporter
+
+	reporter io.Closer
+}
+
+func (e *closingZipkinExporter) Close() error {
+	return e.reporter.Close()
+}
+
+func newZipkinExporter(serviceName string, zipkinURL string) (*closingZipkinExporter, error) {
 	_, err := url.Parse(zipkinURL)
 	if err != nil {
-		return fmt.Errorf("invalid zipkin exporter url: %s", err)
+		return nil, fmt.Errorf("invalid zipkin exporter url: %s", err)
 	}
 
 	localEndpoint, err := openzipkin.NewEndpoint(serviceName, "")
 	if err != nil {
-		return fmt.Errorf("unable to create local endpoint: %s", err)
+		return nil, fmt.Errorf("unable to create local endpoint: %s", err)
 	}
 
 	reporter := zipkinHTTP.NewReporter(zipkinURL)
-	zipkinExporter := zipkin.NewExporter(reporter, localEndpoint)
-
-	trace.RegisterExporter(zipkinExporter)
-	return nil
+	return &closingZipkinExporter{Exporter: zipkin.NewExporter(reporter, localEndpoint), reporter: reporter}, nil
 }
 
 // IsProductionEnvironment determines if we are in a production or
@@ -237,23 +519,3 @@ func IsProductionEnvironment() bool {
 
 	return gcp != "" && !os.IsNotExist(err)
 }
-
-func samplerOptionOrDefault(options []interface{}, defaultSampler trace.Sampler) trace.Sampler {
-	for _, option := range options {
-		if sampler, ok := option.(trace.Sampler); ok {
-			return sampler
-		}
-	}
-
-	return defaultSampler
-}
-
-func traceAttributesOptionOrDefault(options []interface{}, defaultAttributes TraceAttributes) TraceAttributes {
-	for _, option := range options {
-		if attributes, ok := option.(TraceAttributes); ok {
-			return attributes
-		}
-	}
-
-	return defaultAttributes
-}
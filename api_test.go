@@ -16,9 +16,16 @@ package dtracing
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"contrib.go.opencensus.io/exporter/stackdriver"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"golang.org/x/oauth2/google"
 )
 
 func TestGetTraceID(t *testing.T) {
@@ -33,3 +40,171 @@ func TestGetTraceID(t *testing.T) {
 
 	assert.NotEqual(t, traceIDRandomOne, traceIDRandomTwo)
 }
+
+func TestRegisterDevelopmentExportersFromEnv_Filter(t *testing.T) {
+	previousSampler := SetDefaultSampler(trace.AlwaysSample())
+	defer SetDefaultSampler(previousSampler)
+
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	os.Setenv("TRACING_FILE_EXPORTER", path)
+	defer os.Unsetenv("TRACING_FILE_EXPORTER")
+	os.Setenv("TRACING_FILE_EXPORTER_FILTER", "status=error")
+	defer os.Unsetenv("TRACING_FILE_EXPORTER_FILTER")
+
+	shutdown, err := RegisterDevelopmentExportersFromEnv("test", trace.AlwaysSample())
+	require.NoError(t, err)
+
+	_, span := StartSpan(context.Background(), "ok")
+	span.End()
+
+	_, span = StartSpan(context.Background(), "failed")
+	span.SetStatus(trace.Status{Code: trace.StatusCodeInternal, Message: "failed"})
+	span.End()
+
+	require.NoError(t, shutdown(context.Background()))
+
+	recorder := &capturingExporter{}
+	_, err = ReplaySpansFile(path, recorder)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"failed"}, spanNames(recorder.spans))
+
+	os.Setenv("TRACING_ZAP_EXPORTER", "tree")
+	defer os.Unsetenv("TRACING_ZAP_EXPORTER")
+	os.Setenv("TRACING_ZAP_EXPORTER_FILTER", "status=error")
+	defer os.Unsetenv("TRACING_ZAP_EXPORTER_FILTER")
+
+	_, err = RegisterDevelopmentExportersFromEnv("test", trace.AlwaysSample())
+	assert.EqualError(t, err, "TRACING_ZAP_EXPORTER_FILTER cannot be used with TRACING_ZAP_EXPORTER=tree")
+}
+
+func TestSetup_SpanLimits(t *testing.T) {
+	previousSampler := getDefaultSampler()
+	defer SetDefaultSampler(previousSampler)
+	defer SetSpanLimits(SpanLimits{})
+
+	exporter := &capturingExporter{}
+	shutdown, err := Setup("test",
+		WithEnvironment(EnvironmentDevelopment),
+		WithSampler(trace.AlwaysSample()),
+		WithExporter(exporter),
+		WithSpanLimits(SpanLimits{MaxAttributeValueLength: 3}),
+	)
+	require.NoError(t, err)
+
+	_, span := StartSpan(context.Background(), "span")
+	span.AddAttributes(trace.StringAttribute("direct", "abcdef"))
+	span.End()
+
+	require.NoError(t, shutdown(context.Background()))
+
+	require.Len(t, exporter.spans, 1)
+	assert.Equal(t, map[string]interface{}{"direct": "abc", TruncatedValuesAttribute: int64(1)}, exporter.spans[0].Attributes)
+}
+
+func TestSetup_SamplingRules(t *testing.T) {
+	previousSampler := getDefaultSampler()
+	defer SetDefaultSampler(previousSampler)
+
+	rules, err := NewSamplingRules([]SamplingRule{{Name: "/admin/*", Rate: 1}}, nil)
+	require.NoError(t, err)
+
+	shutdown, err := Setup("test", WithEnvironment(EnvironmentDevelopment), WithSamplingRules(rules))
+	require.NoError(t, err)
+	assert.Equal(t, rules, defaultSamplingRules.Load())
+
+	require.NoError(t, shutdown(context.Background()))
+	assert.Nil(t, defaultSamplingRules.Load())
+
+	SetDefaultSamplingRules(rules)
+	shutdown, err = Setup("test", WithEnvironment(EnvironmentDevelopment), WithSampler(trace.AlwaysSample()))
+	require.NoError(t, err)
+	defer shutdown(context.Background())
+
+	assert.Nil(t, defaultSamplingRules.Load(), "rules of a previous setup are cleared")
+}
+
+func TestSetup_GlobalState(t *testing.T) {
+	previousSampler := SetDefaultSampler(trace.NeverSample())
+	defer SetDefaultSampler(previousSampler)
+
+	previousIDGenerator := getIDGenerator()
+	previousFormat := getDefaultFormat()
+	previousSpanLimits := currentSpanLimits.Load().(SpanLimits)
+
+	format := NewCompositeFormat()
+	options := []Option{
+		WithEnvironment(EnvironmentDevelopment),
+		WithSampler(trace.AlwaysSample()),
+		WithIDGenerator(NewCryptoIDGenerator()),
+		WithPropagation(format),
+		WithSpanLimits(SpanLimits{MaxAttributeValueLength: 3}),
+	}
+
+	assertPreviousState := func(t *testing.T) {
+		t.Helper()
+
+		assert.True(t, getIDGenerator() == previousIDGenerator, "id generator")
+		assert.True(t, getDefaultFormat() == previousFormat, "propagation format")
+		assert.Equal(t, previousSpanLimits, currentSpanLimits.Load())
+
+		_, span := StartSpan(context.Background(), "sampled")
+		assert.False(t, span.SpanContext().IsSampled(), "default sampler is never sample")
+		span.End()
+	}
+
+	t.Run("failed setup", func(t *testing.T) {
+		os.Setenv("TRACING_FILE_EXPORTER", filepath.Join(t.TempDir(), "missing", "spans.jsonl"))
+		defer os.Unsetenv("TRACING_FILE_EXPORTER")
+
+		_, err := Setup("test", options...)
+		require.Error(t, err)
+
+		assertPreviousState(t)
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		shutdown, err := Setup("test", options...)
+		require.NoError(t, err)
+
+		assert.Equal(t, cryptoIDGenerator{}, getIDGenerator())
+		assert.True(t, getDefaultFormat() == format, "propagation format")
+		assert.Equal(t, 3, currentSpanLimits.Load().(SpanLimits).MaxAttributeValueLength)
+
+		require.NoError(t, shutdown(context.Background()))
+		assertPreviousState(t)
+	})
+}
+
+func TestResolveStackDriverProjectID(t *testing.T) {
+	defer func() { findDefaultCredentials = google.FindDefaultCredentials }()
+
+	tests := []struct {
+		name          string
+		projectID     string
+		credentials   *google.Credentials
+		credentialErr error
+		expected      string
+		expectedError string
+	}{
+		{"explicit", "explicit", nil, errors.New("not called"), "explicit", ""},
+		{"default credentials", "", &google.Credentials{ProjectID: "default"}, nil, "default", ""},
+		{"no credentials", "", nil, errors.New("not found"), "", "unable to find default credentials: not found"},
+		{"no credentials project", "", &google.Credentials{}, nil, "", "no project found with application default credentials"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			findDefaultCredentials = func(context.Context, ...string) (*google.Credentials, error) {
+				return test.credentials, test.credentialErr
+			}
+
+			projectID, err := resolveStackDriverProjectID(stackdriver.Options{ProjectID: test.projectID})
+			if test.expectedError == "" {
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, projectID)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
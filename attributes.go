@@ -0,0 +1,242 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+)
+
+const nilAttributeValue = "<nil>"
+
+// TraceAttributeMarshaler can be implemented by types passed as keyed attributes to
+// `StartSpan` (and friends) to control how they are recorded on the span.
+type TraceAttributeMarshaler interface {
+	MarshalTraceAttribute(key string) trace.Attribute
+}
+
+var warnedAttributeTypes sync.Map
+
+// toTraceAttribute converts a keyed attribute value to a `trace.Attribute`:
+//
+//   - integers (including named integer types) are recorded as `int64`
+//   - floats are recorded as `float64`
+//   - `time.Duration` and `fmt.Stringer` values are recorded using their `String()` value
+//   - `time.Time` values are recorded in RFC3339 format with nanoseconds
+//   - `error` values are recorded using their `Error()` value
+//   - `[]byte` values are recorded as hexadecimal
+//   - slices and arrays are recorded as a JSON array of their converted elements
+//   - pointers are dereferenced and nil values are recorded as `<nil>`
+//
+// Any other type is recorded using its `%v` representation, a warning being logged
+// the first time the type is seen.
+func toTraceAttribute(logger *zap.Logger, key string, value interface{}) trace.Attribute {
+	if marshaler, ok := value.(TraceAttributeMarshaler); ok && !isNilPointer(value) {
+		return marshaler.MarshalTraceAttribute(key)
+	}
+
+	switch v := toAttributeValue(value).(type) {
+	case bool:
+		return trace.BoolAttribute(key, v)
+	case int64:
+		return trace.Int64Attribute(key, v)
+	case float64:
+		return trace.Float64Attribute(key, v)
+	case string:
+		return trace.StringAttribute(key, v)
+	}
+
+	valueType := reflect.TypeOf(value)
+	if _, alreadyWarned := warnedAttributeTypes.LoadOrStore(valueType, true); !alreadyWarned {
+		logger.Warn("unsupported trace attribute type, recording its fmt %v representation instead", zap.String("key", key), zap.Stringer("type", valueType))
+	}
+
+	return trace.StringAttribute(key, fmt.Sprintf("%v", value))
+}
+
+// toAttributeValue converts the value to a `bool`, `int64`, `float64` or `string`,
+// returning the value unchanged if it's not supported.
+func toAttributeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nilAttributeValue
+	case int, int8, int16, int32, int64, uintptr, uint, uint8, uint16, uint32, uint64:
+		return toInt64(v)
+	case float32:
+		return float64(v)
+	case float64:
+		return v
+	case bool:
+		return v
+	case string:
+		return v
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return hex.EncodeToString(v)
+	}
+
+	if isNilPointer(value) {
+		return nilAttributeValue
+	}
+
+	switch v := value.(type) {
+	case TraceAttributeMarshaler:
+		attribute := v.MarshalTraceAttribute("")
+		return attribute.Value()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	reflectValue := reflect.ValueOf(value)
+	switch reflectValue.Kind() {
+	case reflect.Ptr:
+		return toAttributeValue(reflectValue.Elem().Interface())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflectValue.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(reflectValue.Uint())
+	case reflect.Float32, reflect.Float64:
+		return reflectValue.Float()
+	case reflect.Bool:
+		return reflectValue.Bool()
+	case reflect.String:
+		return reflectValue.String()
+	case reflect.Slice, reflect.Array:
+		if reflectValue.Kind() == reflect.Slice && reflectValue.IsNil() {
+			return nilAttributeValue
+		}
+
+		elements := make([]interface{}, reflectValue.Len())
+		for i := range elements {
+			elements[i] = toAttributeValue(reflectValue.Index(i).Interface())
+		}
+
+		buffer := &bytes.Buffer{}
+		encoder := json.NewEncoder(buffer)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(elements); err == nil {
+			return strings.TrimSuffix(buffer.String(), "\n")
+		}
+	}
+
+	return value
+}
+
+func isNilPointer(value interface{}) bool {
+	reflectValue := reflect.ValueOf(value)
+	return reflectValue.Kind() == reflect.Ptr && reflectValue.IsNil()
+}
+
+// AttributeErrorPolicy controls what happens when the keyed attributes passed to
+// `StartSpan` (and friends) are invalid, i.e. when an odd number of values is given.
+type AttributeErrorPolicy int32
+
+const (
+	// AttributeErrorPolicyAuto panics in development and logs and drops the invalid
+	// attributes in production, see `IsProductionEnvironment`.
+	AttributeErrorPolicyAuto AttributeErrorPolicy = iota
+
+	// AttributeErrorPolicyPanic panics on invalid attributes.
+	AttributeErrorPolicyPanic
+
+	// AttributeErrorPolicyLogAndDrop logs a warning and drops the invalid attributes.
+	AttributeErrorPolicyLogAndDrop
+
+	// AttributeErrorPolicyAnnotate drops the invalid attributes and records an
+	// `attribute_error` annotation on the span describing the error.
+	AttributeErrorPolicyAnnotate
+)
+
+const attributeErrorAnnotation = "attribute_error"
+
+var attributeErrorPolicy int32 // access atomically
+
+// SetAttributeErrorPolicy sets the policy applied on invalid keyed attributes,
+// `AttributeErrorPolicyAuto` being the default.
+func SetAttributeErrorPolicy(policy AttributeErrorPolicy) {
+	atomic.StoreInt32(&attributeErrorPolicy, int32(policy))
+}
+
+func getAttributeErrorPolicy() AttributeErrorPolicy {
+	policy := AttributeErrorPolicy(atomic.LoadInt32(&attributeErrorPolicy))
+	if policy != AttributeErrorPolicyAuto {
+		return policy
+	}
+
+	if IsProductionEnvironment() {
+		return AttributeErrorPolicyLogAndDrop
+	}
+
+	return AttributeErrorPolicyPanic
+}
+
+// MeasureDroppedAttributes counts the keyed attributes dropped because they were invalid.
+var MeasureDroppedAttributes = stats.Int64("github.com/streamingfast/dtracing/dropped_attributes", "Number of keyed span attributes dropped because they were invalid", stats.UnitDimensionless)
+
+// DroppedAttributesView is the total number of keyed attributes dropped because they
+// were invalid, register it with `view.Register` to export it.
+var DroppedAttributesView = &view.View{
+	Name:        "github.com/streamingfast/dtracing/dropped_attributes",
+	Description: "Total number of keyed span attributes dropped because they were invalid",
+	Measure:     MeasureDroppedAttributes,
+	Aggregation: view.Sum(),
+}
+
+const oddKeyedAttributesMessage = "keyedAttributes parameters should be a multiple of 2"
+
+// handleAttributeErrors applies the attribute error policy when `keyedAttributes` has an
+// odd number of values. It's called before the span is started so that panicking never
+// leaves a started span behind, the span must be annotated through
+// `annotateAttributeError` once started when true is returned.
+func handleAttributeErrors(ctx context.Context, logger *zap.Logger, keyedAttributes []interface{}) (annotate bool) {
+	if len(keyedAttributes)%2 == 0 {
+		return false
+	}
+
+	switch getAttributeErrorPolicy() {
+	case AttributeErrorPolicyPanic:
+		logger.Panic(oddKeyedAttributesMessage, zap.Any("keyed_attributes", keyedAttributes))
+	case AttributeErrorPolicyAnnotate:
+		annotate = true
+	default:
+		logger.Warn(oddKeyedAttributesMessage+", dropping invalid attributes", zap.Any("keyed_attributes", keyedAttributes))
+	}
+
+	stats.Record(ctx, MeasureDroppedAttributes.M(1))
+
+	return annotate
+}
+
+func annotateAttributeError(span *trace.Span) {
+	span.Annotate([]trace.Attribute{trace.StringAttribute("error", oddKeyedAttributesMessage)}, attributeErrorAnnotation)
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type testStatus int
+
+type testUser struct {
+	ID   int
+	Name string
+}
+
+func (u *testUser) MarshalTraceAttribute(key string) trace.Attribute {
+	return trace.StringAttribute(key, u.Name)
+}
+
+type testUnsupported struct {
+	Value int
+}
+
+func TestKeyedAttributesToTraceAttributes(t *testing.T) {
+	value := 42
+	var nilUser *testUser
+	var nilError error
+
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected trace.Attribute
+	}{
+		{"int", 1, trace.Int64Attribute("key", 1)},
+		{"uint16", uint16(2), trace.Int64Attribute("key", 2)},
+		{"named int", testStatus(3), trace.Int64Attribute("key", 3)},
+		{"float32", float32(1.5), trace.Float64Attribute("key", 1.5)},
+		{"float64", 2.5, trace.Float64Attribute("key", 2.5)},
+		{"bool", true, trace.BoolAttribute("key", true)},
+		{"string", "value", trace.StringAttribute("key", "value")},
+		{"duration", 1500 * time.Millisecond, trace.StringAttribute("key", "1.5s")},
+		{"time", time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC), trace.StringAttribute("key", "2020-01-02T03:04:05.000000006Z")},
+		{"error", errors.New("failed"), trace.StringAttribute("key", "failed")},
+		{"nil", nil, trace.StringAttribute("key", "<nil>")},
+		{"nil error", nilError, trace.StringAttribute("key", "<nil>")},
+		{"bytes", []byte{0xde, 0xad}, trace.StringAttribute("key", "dead")},
+		{"pointer", &value, trace.Int64Attribute("key", 42)},
+		{"nil pointer", nilUser, trace.StringAttribute("key", "<nil>")},
+		{"slice", []interface{}{1, "a", 1.5, nil}, trace.StringAttribute("key", `[1,"a",1.5,"<nil>"]`)},
+		{"array", [2]time.Duration{time.Second, time.Minute}, trace.StringAttribute("key", `["1s","1m0s"]`)},
+		{"marshaler", &testUser{ID: 1, Name: "alice"}, trace.StringAttribute("key", "alice")},
+		{"unsupported", testUnsupported{Value: 1}, trace.StringAttribute("key", "{1}")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attributes := keyedAttributesToTraceAttributes(zap.NewNop(), []interface{}{"key", test.value})
+			assert.Equal(t, []trace.Attribute{test.expected}, attributes)
+		})
+	}
+}
+
+func TestKeyedAttributesToTraceAttributes_WarnOnce(t *testing.T) {
+	type warnOnceUnsupported struct{}
+
+	// Types warned about by previous runs of the test (e.g. `-count=2`) would not warn again
+	warnedAttributeTypes.Range(func(key, _ interface{}) bool {
+		warnedAttributeTypes.Delete(key)
+		return true
+	})
+
+	core, logs := observer.New(zap.WarnLevel)
+	logger := zap.New(core)
+
+	keyedAttributesToTraceAttributes(logger, []interface{}{"first", warnOnceUnsupported{}, "second", map[string]int{}})
+	keyedAttributesToTraceAttributes(logger, []interface{}{"first", warnOnceUnsupported{}})
+
+	assert.Equal(t, 2, logs.Len())
+}
+
+func TestAttributeErrorPolicy(t *testing.T) {
+	defer SetAttributeErrorPolicy(AttributeErrorPolicyAuto)
+
+	exporter := &capturingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	require.NoError(t, view.Register(DroppedAttributesView))
+	defer view.Unregister(DroppedAttributesView)
+
+	core, logs := observer.New(zap.WarnLevel)
+	ctx := logging.WithLogger(context.Background(), zap.New(core))
+	sampler := trace.AlwaysSample()
+
+	SetAttributeErrorPolicy(AttributeErrorPolicyPanic)
+	assert.Panics(t, func() { StartSpanWithSampler(ctx, "odd", sampler, "key", 1, "missing") })
+	assert.Empty(t, exporter.spans, "no span is started when panicking")
+	logs.TakeAll()
+
+	SetAttributeErrorPolicy(AttributeErrorPolicyLogAndDrop)
+	_, span := StartSpanWithSampler(ctx, "log", sampler, "key", 1, 2, "int key", "missing")
+	span.End()
+
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t, "keyedAttributes parameters should be a multiple of 2, dropping invalid attributes", logs.All()[0].Message)
+
+	SetAttributeErrorPolicy(AttributeErrorPolicyAnnotate)
+	_, span = StartFreshSpanWithSampler(ctx, "annotate", sampler, "key", 1, "missing")
+	span.End()
+
+	require.Len(t, exporter.spans, 2)
+	assert.Equal(t, map[string]interface{}{"key": int64(1), "int": "int key"}, exporter.spans[0].Attributes)
+	assert.Empty(t, exporter.spans[0].Annotations)
+
+	assert.Equal(t, map[string]interface{}{"key": int64(1)}, exporter.spans[1].Attributes)
+	require.Len(t, exporter.spans[1].Annotations, 1)
+	assert.Equal(t, "attribute_error", exporter.spans[1].Annotations[0].Message)
+	assert.Equal(t, "keyedAttributes parameters should be a multiple of 2", exporter.spans[1].Annotations[0].Attributes["error"])
+
+	rows, err := view.RetrieveData(DroppedAttributesView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, float64(2), rows[0].Data.(*view.SumData).Value)
+}
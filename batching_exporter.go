@@ -0,0 +1,384 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// DropPolicy controls which spans are dropped when the queue of a batching exporter
+// is full.
+type DropPolicy int
+
+const (
+	// DropPolicyOldest drops the oldest queued span to make room for the new one.
+	DropPolicyOldest DropPolicy = iota
+
+	// DropPolicyNewest drops the new span, keeping the queued ones.
+	DropPolicyNewest
+)
+
+const (
+	defaultBatchingQueueSize = 2048
+	defaultBatchingBatchSize = 512
+	defaultBatchingInterval  = 5 * time.Second
+	defaultBatchingWorkers   = 1
+)
+
+// BatchingOption configures the exporter returned by `NewBatchingExporter`.
+type BatchingOption func(exporter *BatchingExporter)
+
+// WithBatchingQueueSize sets the maximum number of queued spans, defaults to 2048 which
+// is also used when `queueSize` is not positive.
+func WithBatchingQueueSize(queueSize int) BatchingOption {
+	return func(exporter *BatchingExporter) {
+		exporter.queueSize = queueSize
+	}
+}
+
+// WithBatchingBatchSize sets the number of queued spans triggering an export, defaults
+// to 512 which is also used when `batchSize` is not positive. It's capped to the queue
+// size.
+func WithBatchingBatchSize(batchSize int) BatchingOption {
+	return func(exporter *BatchingExporter) {
+		exporter.batchSize = batchSize
+	}
+}
+
+// WithBatchingInterval sets the maximum time a span stays queued before being
+// exported, defaults to 5 seconds which is also used when `interval` is not positive.
+func WithBatchingInterval(interval time.Duration) BatchingOption {
+	return func(exporter *BatchingExporter) {
+		exporter.interval = interval
+	}
+}
+
+// WithBatchingWorkers sets the number of background goroutines exporting batches,
+// defaults to 1 which is also used when `workers` is not positive.
+func WithBatchingWorkers(workers int) BatchingOption {
+	return func(exporter *BatchingExporter) {
+		exporter.workers = workers
+	}
+}
+
+// WithBatchingDropPolicy sets the policy applied when the queue is full, defaults to
+// `DropPolicyOldest`.
+func WithBatchingDropPolicy(policy DropPolicy) BatchingOption {
+	return func(exporter *BatchingExporter) {
+		exporter.dropPolicy = policy
+	}
+}
+
+// WithBatchingName sets the value of the `exporter` tag of the stats recorded by the
+// exporter, defaults to the type of the wrapped exporter.
+func WithBatchingName(name string) BatchingOption {
+	return func(exporter *BatchingExporter) {
+		exporter.name = name
+	}
+}
+
+var (
+	exporterTagKey = tag.MustNewKey("exporter")
+
+	// MeasureBatchingQueueDepth is the number of spans queued by batching exporters.
+	MeasureBatchingQueueDepth = stats.Int64("github.com/streamingfast/dtracing/batching/queue_depth", "Number of spans queued by the batching exporter", stats.UnitDimensionless)
+
+	// MeasureBatchingDroppedSpans counts the spans dropped by batching exporters.
+	MeasureBatchingDroppedSpans = stats.Int64("github.com/streamingfast/dtracing/batching/dropped_spans", "Number of spans dropped by the batching exporter", stats.UnitDimensionless)
+
+	// MeasureBatchingExportLatency is the time taken to export a batch of spans.
+	MeasureBatchingExportLatency = stats.Float64("github.com/streamingfast/dtracing/batching/export_latency", "Time taken to export a batch of spans", stats.UnitMilliseconds)
+)
+
+var (
+	// BatchingQueueDepthView is the last queue depth of batching exporters, by exporter.
+	BatchingQueueDepthView = &view.View{
+		Name:        "github.com/streamingfast/dtracing/batching/queue_depth",
+		Description: "Number of spans queued by the batching exporter",
+		Measure:     MeasureBatchingQueueDepth,
+		TagKeys:     []tag.Key{exporterTagKey},
+		Aggregation: view.LastValue(),
+	}
+
+	// BatchingDroppedSpansView is the total number of spans dropped by batching exporters,
+	// by exporter.
+	BatchingDroppedSpansView = &view.View{
+		Name:        "github.com/streamingfast/dtracing/batching/dropped_spans",
+		Description: "Total number of spans dropped by the batching exporter",
+		Measure:     MeasureBatchingDroppedSpans,
+		TagKeys:     []tag.Key{exporterTagKey},
+		Aggregation: view.Sum(),
+	}
+
+	// BatchingExportLatencyView is the distribution of the time taken to export a batch
+	// of spans, by exporter.
+	BatchingExportLatencyView = &view.View{
+		Name:        "github.com/streamingfast/dtracing/batching/export_latency",
+		Description: "Distribution of the time taken to export a batch of spans",
+		Measure:     MeasureBatchingExportLatency,
+		TagKeys:     []tag.Key{exporterTagKey},
+		Aggregation: view.Distribution(1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000),
+	}
+)
+
+// BatchingExporter is a `trace.Exporter` queuing spans in a bounded queue and exporting
+// them to the wrapped exporter in batches on background goroutines, so that slow
+// exporters do not add latency to the goroutine ending the span.
+type BatchingExporter struct {
+	inner      trace.Exporter
+	queueSize  int
+	batchSize  int
+	interval   time.Duration
+	workers    int
+	dropPolicy DropPolicy
+	name       string
+	statsCtx   context.Context
+
+	lock     sync.Mutex
+	idle     *sync.Cond
+	queue    []*trace.SpanData
+	inflight int
+	closed   bool
+
+	ready    chan struct{}
+	done     chan struct{}
+	workerWG sync.WaitGroup
+}
+
+// Compile time assertion that the exporter implements trace.Exporter
+var _ trace.Exporter = (*BatchingExporter)(nil)
+
+// NewBatchingExporter returns an exporter queuing spans and exporting them to `inner`
+// in batches, once `batchSize` spans are queued or every `interval`. When the queue
+// is full, spans are dropped according to the drop policy. The queue depth, dropped
+// spans and export latency are recorded as OpenCensus stats, see the `Batching*View`
+// views.
+//
+// `Flush` exports all queued spans synchronously and `Close` stops the background
+// goroutines, exports the queued spans and closes `inner` if it's an `io.Closer`.
+func NewBatchingExporter(inner trace.Exporter, options ...BatchingOption) *BatchingExporter {
+	exporter := &BatchingExporter{
+		inner:      inner,
+		queueSize:  defaultBatchingQueueSize,
+		batchSize:  defaultBatchingBatchSize,
+		interval:   defaultBatchingInterval,
+		workers:    defaultBatchingWorkers,
+		dropPolicy: DropPolicyOldest,
+		name:       fmt.Sprintf("%T", inner),
+		ready:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	for _, option := range options {
+		option(exporter)
+	}
+
+	if exporter.queueSize <= 0 {
+		exporter.queueSize = defaultBatchingQueueSize
+	}
+
+	if exporter.batchSize <= 0 {
+		exporter.batchSize = defaultBatchingBatchSize
+	}
+
+	if exporter.interval <= 0 {
+		exporter.interval = defaultBatchingInterval
+	}
+
+	if exporter.workers <= 0 {
+		exporter.workers = defaultBatchingWorkers
+	}
+
+	if exporter.batchSize > exporter.queueSize {
+		exporter.batchSize = exporter.queueSize
+	}
+
+	exporter.idle = sync.NewCond(&exporter.lock)
+	exporter.queue = make([]*trace.SpanData, 0, exporter.queueSize)
+	exporter.statsCtx, _ = tag.New(context.Background(), tag.Upsert(exporterTagKey, exporter.name))
+
+	exporter.workerWG.Add(exporter.workers)
+	for i := 0; i < exporter.workers; i++ {
+		go exporter.work()
+	}
+
+	return exporter
+}
+
+func (e *BatchingExporter) ExportSpan(span *trace.SpanData) {
+	e.lock.Lock()
+
+	if e.closed {
+		e.lock.Unlock()
+		stats.Record(e.statsCtx, MeasureBatchingDroppedSpans.M(1))
+		return
+	}
+
+	dropped := int64(0)
+	if len(e.queue) >= e.queueSize {
+		dropped = 1
+		if e.dropPolicy == DropPolicyNewest {
+			e.lock.Unlock()
+			stats.Record(e.statsCtx, MeasureBatchingDroppedSpans.M(1))
+			return
+		}
+
+		e.queue[0] = nil
+		e.queue = e.queue[1:]
+	}
+
+	e.queue = append(e.queue, span)
+	depth := len(e.queue)
+	e.lock.Unlock()
+
+	if depth >= e.batchSize {
+		select {
+		case e.ready <- struct{}{}:
+		default:
+		}
+	}
+
+	measurements := []stats.Measurement{MeasureBatchingQueueDepth.M(int64(depth))}
+	if dropped > 0 {
+		measurements = append(measurements, MeasureBatchingDroppedSpans.M(dropped))
+	}
+	stats.Record(e.statsCtx, measurements...)
+}
+
+func (e *BatchingExporter) work() {
+	defer e.workerWG.Done()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+			e.exportBatches(1)
+		case <-e.ready:
+			e.exportBatches(e.batchSize)
+		}
+	}
+}
+
+// exportBatches exports batches as long as at least `minSize` spans are queued.
+func (e *BatchingExporter) exportBatches(minSize int) {
+	for {
+		e.lock.Lock()
+		if len(e.queue) < minSize || len(e.queue) == 0 {
+			e.lock.Unlock()
+			return
+		}
+
+		batch := e.takeBatch(e.batchSize)
+		e.lock.Unlock()
+
+		e.export(batch)
+	}
+}
+
+// takeBatch must be called with the lock held, `export` must be called with the
+// returned batch.
+func (e *BatchingExporter) takeBatch(size int) []*trace.SpanData {
+	if size > len(e.queue) {
+		size = len(e.queue)
+	}
+
+	batch := make([]*trace.SpanData, size)
+	copy(batch, e.queue)
+
+	// Shift remaining spans so the queue's backing array is reused
+	remaining := copy(e.queue, e.queue[size:])
+	for i := remaining; i < len(e.queue); i++ {
+		e.queue[i] = nil
+	}
+	e.queue = e.queue[:remaining]
+
+	e.inflight++
+	stats.Record(e.statsCtx, MeasureBatchingQueueDepth.M(int64(remaining)))
+
+	return batch
+}
+
+func (e *BatchingExporter) export(batch []*trace.SpanData) {
+	start := time.Now()
+	for _, span := range batch {
+		e.inner.ExportSpan(span)
+	}
+	stats.Record(e.statsCtx, MeasureBatchingExportLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+
+	e.lock.Lock()
+	e.inflight--
+	e.idle.Broadcast()
+	e.lock.Unlock()
+}
+
+// Flush exports all queued spans, waits for batches being exported by background
+// goroutines and flushes the wrapped exporter if it has a `Flush()` method.
+func (e *BatchingExporter) Flush() {
+	e.lock.Lock()
+	var batch []*trace.SpanData
+	if len(e.queue) > 0 {
+		batch = e.takeBatch(len(e.queue))
+	}
+	e.lock.Unlock()
+
+	if batch != nil {
+		e.export(batch)
+	}
+
+	e.lock.Lock()
+	for e.inflight > 0 {
+		e.idle.Wait()
+	}
+	e.lock.Unlock()
+
+	if flusher, ok := e.inner.(flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close stops the background goroutines, exports all queued spans and closes the
+// wrapped exporter if it's an `io.Closer`. Spans exported afterwards are dropped.
+func (e *BatchingExporter) Close() error {
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.lock.Unlock()
+
+	close(e.done)
+	e.workerWG.Wait()
+	e.Flush()
+
+	if closer, ok := e.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
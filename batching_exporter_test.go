@@ -0,0 +1,174 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+)
+
+// blockingExporter blocks the first exported span until `release` is closed.
+type blockingExporter struct {
+	capturingExporter
+
+	started chan struct{}
+	release chan struct{}
+	closed  bool
+}
+
+func newBlockingExporter() *blockingExporter {
+	return &blockingExporter{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (e *blockingExporter) ExportSpan(span *trace.SpanData) {
+	select {
+	case <-e.started:
+	default:
+		close(e.started)
+		<-e.release
+	}
+
+	e.capturingExporter.ExportSpan(span)
+}
+
+func (e *blockingExporter) Close() error {
+	e.closed = true
+	return nil
+}
+
+func TestBatchingExporter_DropPolicies(t *testing.T) {
+	require.NoError(t, view.Register(BatchingDroppedSpansView))
+	defer view.Unregister(BatchingDroppedSpansView)
+
+	tests := []struct {
+		name          string
+		policy        DropPolicy
+		expectedNames []string
+	}{
+		{"oldest", DropPolicyOldest, []string{"first", "third", "fourth"}},
+		{"newest", DropPolicyNewest, []string{"first", "second", "third"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inner := newBlockingExporter()
+			exporter := NewBatchingExporter(inner,
+				WithBatchingName(test.name),
+				WithBatchingQueueSize(2),
+				WithBatchingBatchSize(1),
+				WithBatchingInterval(time.Hour),
+				WithBatchingDropPolicy(test.policy),
+			)
+
+			exporter.ExportSpan(&trace.SpanData{Name: "first"})
+			<-inner.started
+
+			exporter.ExportSpan(&trace.SpanData{Name: "second"})
+			exporter.ExportSpan(&trace.SpanData{Name: "third"})
+			exporter.ExportSpan(&trace.SpanData{Name: "fourth"})
+
+			close(inner.release)
+			require.NoError(t, exporter.Close())
+			assert.True(t, inner.closed)
+
+			exporter.ExportSpan(&trace.SpanData{Name: "after close"})
+
+			assert.Equal(t, test.expectedNames, spanNames(inner.spans))
+
+			rows, err := view.RetrieveData(BatchingDroppedSpansView.Name)
+			require.NoError(t, err)
+
+			var dropped float64
+			for _, row := range rows {
+				if row.Tags[0].Value == test.name {
+					dropped = row.Data.(*view.SumData).Value
+				}
+			}
+			assert.Equal(t, float64(2), dropped)
+		})
+	}
+}
+
+func TestBatchingExporter_FlushByInterval(t *testing.T) {
+	require.NoError(t, view.Register(BatchingQueueDepthView, BatchingExportLatencyView))
+	defer view.Unregister(BatchingQueueDepthView, BatchingExportLatencyView)
+
+	inner := &capturingExporter{}
+	exporter := NewBatchingExporter(inner, WithBatchingName("interval"), WithBatchingInterval(10*time.Millisecond), WithBatchingWorkers(2))
+	defer exporter.Close()
+
+	exporter.ExportSpan(&trace.SpanData{Name: "first"})
+	exporter.ExportSpan(&trace.SpanData{Name: "second"})
+
+	require.Eventually(t, func() bool {
+		inner.lock.Lock()
+		defer inner.lock.Unlock()
+
+		return len(inner.spans) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	exporter.Flush()
+
+	rows, err := view.RetrieveData(BatchingQueueDepthView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, float64(0), rows[0].Data.(*view.LastValueData).Value)
+
+	rows, err = view.RetrieveData(BatchingExportLatencyView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.NotZero(t, rows[0].Data.(*view.DistributionData).Count)
+}
+
+func TestBatchingExporter_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		option BatchingOption
+	}{
+		{"zero queue size", WithBatchingQueueSize(0)},
+		{"zero batch size", WithBatchingBatchSize(0)},
+		{"negative batch size", WithBatchingBatchSize(-1)},
+		{"zero interval", WithBatchingInterval(0)},
+		{"negative interval", WithBatchingInterval(-time.Second)},
+		{"zero workers", WithBatchingWorkers(0)},
+		{"negative workers", WithBatchingWorkers(-1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inner := &capturingExporter{}
+			exporter := NewBatchingExporter(inner, test.option)
+
+			for i := 0; i < defaultBatchingBatchSize; i++ {
+				exporter.ExportSpan(&trace.SpanData{Name: "span"})
+			}
+
+			// A full batch is exported by the background workers without flushing
+			require.Eventually(t, func() bool {
+				inner.lock.Lock()
+				defer inner.lock.Unlock()
+
+				return len(inner.spans) == defaultBatchingBatchSize
+			}, time.Second, 5*time.Millisecond)
+
+			require.NoError(t, exporter.Close())
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracingtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
+)
+
+// AssertAttribute asserts that the span has the attribute `key` set to `expected`.
+func AssertAttribute(t testing.TB, span *trace.SpanData, key string, expected interface{}) bool {
+	t.Helper()
+
+	actual, found := span.Attributes[key]
+	if !found {
+		return assert.Fail(t, "attribute not found", "span %q has no attribute %q, got %v", span.Name, key, span.Attributes)
+	}
+
+	return assert.Equal(t, normalizeAttributeValue(expected), actual, "span %q attribute %q", span.Name, key)
+}
+
+// AssertAttributes asserts that the span has all the `expected` attributes, other
+// attributes of the span are ignored.
+func AssertAttributes(t testing.TB, span *trace.SpanData, expected map[string]interface{}) bool {
+	t.Helper()
+
+	success := true
+	for key, value := range expected {
+		success = AssertAttribute(t, span, key, value) && success
+	}
+
+	return success
+}
+
+// AssertNoAttribute asserts that the span does not have the attribute `key`.
+func AssertNoAttribute(t testing.TB, span *trace.SpanData, key string) bool {
+	t.Helper()
+
+	return assert.NotContains(t, span.Attributes, key, "span %q attribute %q", span.Name, key)
+}
+
+// AssertAnnotation asserts that the span has an annotation with the given message and
+// returns it, nil if not found.
+func AssertAnnotation(t testing.TB, span *trace.SpanData, message string) *trace.Annotation {
+	t.Helper()
+
+	messages := make([]string, len(span.Annotations))
+	for i, annotation := range span.Annotations {
+		if annotation.Message == message {
+			return &span.Annotations[i]
+		}
+
+		messages[i] = annotation.Message
+	}
+
+	assert.Fail(t, "annotation not found", "span %q has no annotation %q, got %q", span.Name, message, messages)
+	return nil
+}
+
+// AssertStatus asserts the status code and message of the span.
+func AssertStatus(t testing.TB, span *trace.SpanData, code int32, message string) bool {
+	t.Helper()
+
+	return assert.Equal(t, trace.Status{Code: code, Message: message}, span.Status, "span %q status", span.Name)
+}
+
+// AssertLink asserts that the span has a link to the span `spanID` of trace `traceID`.
+func AssertLink(t testing.TB, span *trace.SpanData, traceID trace.TraceID, spanID trace.SpanID) bool {
+	t.Helper()
+
+	for _, link := range span.Links {
+		if link.TraceID == traceID && link.SpanID == spanID {
+			return true
+		}
+	}
+
+	return assert.Fail(t, "link not found", "span %q has no link to %s/%s, got %v", span.Name, traceID, spanID, span.Links)
+}
+
+// AssertChildOf asserts that `child` is a direct child of `parent`.
+func AssertChildOf(t testing.TB, parent, child *trace.SpanData) bool {
+	t.Helper()
+
+	return assert.Equal(t, parent.TraceID, child.TraceID, "span %q trace id", child.Name) &&
+		assert.Equal(t, parent.SpanID, child.ParentSpanID, "span %q parent span id, expected %q", child.Name, parent.Name)
+}
+
+// normalizeAttributeValue converts integer values to `int64`, the type OpenCensus
+// stores integer attributes as.
+func normalizeAttributeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	}
+
+	return value
+}
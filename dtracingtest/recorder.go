@@ -0,0 +1,249 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dtracingtest provides an in-memory span recorder and assertion helpers
+// to test tracing behavior in unit tests.
+//
+//	func TestHandler(t *testing.T) {
+//		recorder := dtracingtest.RegisterSpanRecorder(t)
+//
+//		ctx := dtracingtest.FixedTraceIDContext(context.Background(), "00000000000000000000000000000001")
+//		handle(ctx)
+//
+//		span := recorder.RequireSpan(t, "handle")
+//		dtracingtest.AssertAttribute(t, span, "user", "alice")
+//	}
+package dtracingtest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/dtracing"
+	"go.opencensus.io/trace"
+)
+
+// SpanRecorder is a `trace.Exporter` capturing exported spans in memory.
+type SpanRecorder struct {
+	lock    sync.Mutex
+	spans   []*trace.SpanData
+	changed chan struct{}
+}
+
+// Compile time assertion that the recorder implements trace.Exporter
+var _ trace.Exporter = (*SpanRecorder)(nil)
+
+// NewSpanRecorder returns a recorder that is not registered, see `RegisterSpanRecorder`
+// to register it for the duration of a test.
+func NewSpanRecorder() *SpanRecorder {
+	return &SpanRecorder{changed: make(chan struct{})}
+}
+
+// RegisterSpanRecorder registers a new recorder as an OpenCensus exporter and sets the
+// default sampler to always sample, so that every span started by the test is recorded.
+// Both are reverted when the test completes, the previous default sampler being restored
+// (see `dtracing.SetDefaultSampler` for how it's tracked).
+func RegisterSpanRecorder(t testing.TB) *SpanRecorder {
+	recorder := NewSpanRecorder()
+
+	trace.RegisterExporter(recorder)
+	previousSampler := dtracing.SetDefaultSampler(trace.AlwaysSample())
+
+	t.Cleanup(func() {
+		trace.UnregisterExporter(recorder)
+		dtracing.SetDefaultSampler(previousSampler)
+	})
+
+	return recorder
+}
+
+// FixedTraceIDContext returns a context holding a remote parent span with the
+// given trace ID (see `dtracing.NewFixedTraceIDInContext`), so spans started from it
+// get a deterministic trace ID. Spans directly started from it are roots of `Tree`.
+func FixedTraceIDContext(ctx context.Context, hexTraceID string) context.Context {
+	return dtracing.NewFixedTraceIDInContext(ctx, hexTraceID)
+}
+
+func (r *SpanRecorder) ExportSpan(span *trace.SpanData) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.spans = append(r.spans, span)
+
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Spans returns the spans recorded so far, in the order they ended.
+func (r *SpanRecorder) Spans() []*trace.SpanData {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]*trace.SpanData(nil), r.spans...)
+}
+
+// Reset forgets all the spans recorded so far.
+func (r *SpanRecorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.spans = nil
+}
+
+// WaitForSpans waits until at least `count` spans have been recorded and returns them,
+// failing the test if it takes longer than `timeout`.
+func (r *SpanRecorder) WaitForSpans(t testing.TB, count int, timeout time.Duration) []*trace.SpanData {
+	t.Helper()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		r.lock.Lock()
+		spans, changed := append([]*trace.SpanData(nil), r.spans...), r.changed
+		r.lock.Unlock()
+
+		if len(spans) >= count {
+			return spans
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			t.Fatalf("timed out after %s waiting for %d spans, got %d: %s", timeout, count, len(spans), spanNames(spans))
+			return nil
+		}
+	}
+}
+
+// FindByName returns the recorded spans with the given name.
+func (r *SpanRecorder) FindByName(name string) []*trace.SpanData {
+	return r.filter(func(span *trace.SpanData) bool { return span.Name == name })
+}
+
+// FindByAttribute returns the recorded spans having the attribute `key` set to `value`.
+// Attributes are stored by OpenCensus as `string`, `bool`, `int64` or `float64`, so an
+// `int` value is compared as an `int64`.
+func (r *SpanRecorder) FindByAttribute(key string, value interface{}) []*trace.SpanData {
+	value = normalizeAttributeValue(value)
+	return r.filter(func(span *trace.SpanData) bool {
+		actual, found := span.Attributes[key]
+		return found && actual == value
+	})
+}
+
+// FindByTraceID returns the recorded spans belonging to the trace with the given ID,
+// typically the one passed to `FixedTraceIDContext`. Any format accepted by
+// `dtracing.ParseTraceID` can be used, the test is stopped when the ID is invalid.
+func (r *SpanRecorder) FindByTraceID(t testing.TB, traceIDValue string) []*trace.SpanData {
+	t.Helper()
+
+	traceID, err := dtracing.ParseTraceID(traceIDValue)
+	if err != nil {
+		t.Fatalf("invalid trace ID %q: %s", traceIDValue, err)
+		return nil
+	}
+
+	return r.filter(func(span *trace.SpanData) bool { return span.TraceID == traceID })
+}
+
+// RequireSpan returns the first recorded span with the given name, stopping the test
+// if there is none.
+func (r *SpanRecorder) RequireSpan(t testing.TB, name string) *trace.SpanData {
+	t.Helper()
+
+	spans := r.FindByName(name)
+	if len(spans) == 0 {
+		t.Fatalf("no span named %q recorded, got %s", name, spanNames(r.Spans()))
+		return nil
+	}
+
+	return spans[0]
+}
+
+func (r *SpanRecorder) filter(predicate func(span *trace.SpanData) bool) (out []*trace.SpanData) {
+	for _, span := range r.Spans() {
+		if predicate(span) {
+			out = append(out, span)
+		}
+	}
+
+	return
+}
+
+// SpanNode is a recorded span along with its recorded children, see `SpanRecorder.Tree`.
+type SpanNode struct {
+	Span     *trace.SpanData
+	Children []*SpanNode
+}
+
+// Tree rebuilds the parent/child relationships of the recorded spans. Spans whose parent
+// was not recorded are returned as roots. Roots and children are ordered by start time.
+func (r *SpanRecorder) Tree() []*SpanNode {
+	spans := r.Spans()
+
+	nodes := make(map[trace.SpanID]*SpanNode, len(spans))
+	for _, span := range spans {
+		nodes[span.SpanID] = &SpanNode{Span: span}
+	}
+
+	var roots []*SpanNode
+	for _, span := range spans {
+		node := nodes[span.SpanID]
+		if parent, found := nodes[span.ParentSpanID]; found && parent.Span.TraceID == span.TraceID {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	sortNodes(roots)
+	return roots
+}
+
+func sortNodes(nodes []*SpanNode) {
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Span.StartTime.Before(nodes[j].Span.StartTime) })
+	for _, node := range nodes {
+		sortNodes(node.Children)
+	}
+}
+
+// String renders the node and its descendants as an indented list of span names.
+func (n *SpanNode) String() string {
+	builder := &strings.Builder{}
+	n.write(builder, 0)
+
+	return strings.TrimSuffix(builder.String(), "\n")
+}
+
+func (n *SpanNode) write(builder *strings.Builder, depth int) {
+	fmt.Fprintf(builder, "%s%s\n", strings.Repeat("  ", depth), n.Span.Name)
+	for _, child := range n.Children {
+		child.write(builder, depth+1)
+	}
+}
+
+func spanNames(spans []*trace.SpanData) []string {
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+
+	return names
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracingtest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/dtracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+)
+
+func TestSpanRecorder(t *testing.T) {
+	recorder := RegisterSpanRecorder(t)
+
+	ctx := FixedTraceIDContext(context.Background(), "00000000000000000000000000000001")
+	linked := trace.SpanContext{TraceID: dtracing.NewFixedTraceID("00000000000000000000000000000002"), SpanID: trace.SpanID{1}}
+
+	go func() {
+		ctx, root := dtracing.StartSpan(ctx, "root", "user", "alice", "count", 2)
+		root.AddLink(trace.Link{TraceID: linked.TraceID, SpanID: linked.SpanID, Type: trace.LinkTypeChild})
+
+		_, first := dtracing.StartSpan(ctx, "first")
+		first.Annotate(nil, "cache miss")
+		first.End()
+
+		_, second := dtracing.StartSpan(ctx, "second")
+		second.SetStatus(trace.Status{Code: trace.StatusCodeNotFound, Message: "not found"})
+		second.End()
+
+		root.End()
+	}()
+
+	spans := recorder.WaitForSpans(t, 3, time.Second)
+	require.Len(t, spans, 3)
+	assert.Len(t, recorder.FindByTraceID(t, "00000000000000000000000000000001"), 3)
+
+	fatal := &fatalRecorder{TB: t}
+	recorder.FindByTraceID(fatal, "not-hex")
+	assert.Contains(t, fatal.message, `invalid trace ID "not-hex"`)
+
+	root := recorder.RequireSpan(t, "root")
+	AssertAttributes(t, root, map[string]interface{}{"user": "alice", "count": 2})
+	AssertNoAttribute(t, root, "unknown")
+	AssertLink(t, root, linked.TraceID, linked.SpanID)
+	assert.Equal(t, []*trace.SpanData{root}, recorder.FindByAttribute("count", 2))
+
+	first := recorder.RequireSpan(t, "first")
+	AssertChildOf(t, root, first)
+	assert.NotNil(t, AssertAnnotation(t, first, "cache miss"))
+
+	AssertStatus(t, recorder.RequireSpan(t, "second"), trace.StatusCodeNotFound, "not found")
+
+	tree := recorder.Tree()
+	require.Len(t, tree, 1)
+	assert.Equal(t, "root\n  first\n  second", tree[0].String())
+
+	recorder.Reset()
+	assert.Empty(t, recorder.Spans())
+}
+
+func TestRegisterSpanRecorder_RestoresSampler(t *testing.T) {
+	previous := dtracing.SetDefaultSampler(trace.NeverSample())
+	defer dtracing.SetDefaultSampler(previous)
+
+	t.Run("recording", func(t *testing.T) {
+		RegisterSpanRecorder(t)
+
+		_, span := trace.StartSpan(context.Background(), "sampled")
+		assert.True(t, span.SpanContext().IsSampled())
+		span.End()
+	})
+
+	_, span := trace.StartSpan(context.Background(), "not sampled")
+	assert.False(t, span.SpanContext().IsSampled(), "previous sampler is restored")
+	span.End()
+}
+
+// fatalRecorder records the message of `Fatalf` instead of stopping the test.
+type fatalRecorder struct {
+	testing.TB
+	message string
+}
+
+func (r *fatalRecorder) Helper() {}
+
+func (r *fatalRecorder) Fatalf(format string, args ...interface{}) {
+	r.message = fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,329 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+	"go.uber.org/multierr"
+	"google.golang.org/grpc/codes"
+)
+
+// SpanFilter decides if a span should be sent to an exporter, see `FanOutExporter`.
+type SpanFilter func(span *trace.SpanData) bool
+
+// FilterSpanName matches spans whose name matches the glob `pattern`, where `*` matches
+// any sequence of characters (including `/`) and `?` matches a single character.
+func FilterSpanName(pattern string) SpanFilter {
+	glob := compileGlob(pattern)
+
+	return func(span *trace.SpanData) bool {
+		return glob.MatchString(span.Name)
+	}
+}
+
+// FilterAttribute matches spans having the attribute `key` with a value whose `%v`
+// representation is the same as the one of `value`.
+func FilterAttribute(key string, value interface{}) SpanFilter {
+	expected := fmt.Sprintf("%v", value)
+
+	return func(span *trace.SpanData) bool {
+		actual, found := span.Attributes[key]
+		return found && fmt.Sprintf("%v", actual) == expected
+	}
+}
+
+// FilterStatusCode matches spans whose status code is one of `codes`.
+func FilterStatusCode(codes ...int32) SpanFilter {
+	return func(span *trace.SpanData) bool {
+		for _, code := range codes {
+			if span.Code == code {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// FilterErrors matches spans whose status code is not `OK`.
+func FilterErrors() SpanFilter {
+	return func(span *trace.SpanData) bool {
+		return span.Code != trace.StatusCodeOK
+	}
+}
+
+// FilterMinDuration matches spans that lasted at least `duration`.
+func FilterMinDuration(duration time.Duration) SpanFilter {
+	return func(span *trace.SpanData) bool {
+		return span.EndTime.Sub(span.StartTime) >= duration
+	}
+}
+
+// FilterSpanKind matches spans whose kind is one of `kinds` (`trace.SpanKind*`).
+func FilterSpanKind(kinds ...int) SpanFilter {
+	return func(span *trace.SpanData) bool {
+		for _, kind := range kinds {
+			if span.SpanKind == kind {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// FilterAll matches spans matched by all `filters`, or all spans if there are no filters.
+func FilterAll(filters ...SpanFilter) SpanFilter {
+	return func(span *trace.SpanData) bool {
+		for _, filter := range filters {
+			if !filter(span) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// FilterAny matches spans matched by at least one of `filters`.
+func FilterAny(filters ...SpanFilter) SpanFilter {
+	return func(span *trace.SpanData) bool {
+		for _, filter := range filters {
+			if filter(span) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// FilterNot matches spans not matched by `filter`.
+func FilterNot(filter SpanFilter) SpanFilter {
+	return func(span *trace.SpanData) bool {
+		return !filter(span)
+	}
+}
+
+// ParseSpanFilter parses a filter expression made of comma separated terms, all of which
+// must match for a span to be matched. A term is of the form `field=value` or
+// `field!=value` (negated), multiple alternative values can be separated by `|`. The
+// supported fields are:
+//
+//   - `name`: span name glob, see `FilterSpanName`
+//   - `status`: `ok`, `error` (any status but `OK`), a gRPC code name (`NotFound`,
+//     `deadline_exceeded`, case and underscores are ignored) or number
+//   - `kind`: `server`, `client` or `unspecified`
+//   - `min_duration`: minimum span duration (`100ms` for example), cannot be negated
+//   - `attr.<key>`: attribute value, see `FilterAttribute`
+//
+// For example, `name=/api/*,name!=/api/health,status=error|DeadlineExceeded` matches
+// failed spans of the API, the health check excepted.
+func ParseSpanFilter(expression string) (SpanFilter, error) {
+	var filters []SpanFilter
+	for _, term := range strings.Split(expression, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		filter, err := parseSpanFilterTerm(term)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter term %q: %s", term, err)
+		}
+
+		filters = append(filters, filter)
+	}
+
+	return FilterAll(filters...), nil
+}
+
+func parseSpanFilterTerm(term string) (SpanFilter, error) {
+	equalIndex := strings.Index(term, "=")
+	if equalIndex <= 0 {
+		return nil, fmt.Errorf("expected field=value or field!=value")
+	}
+
+	field, negated := term[:equalIndex], false
+	if strings.HasSuffix(field, "!") {
+		field, negated = strings.TrimSuffix(field, "!"), true
+	}
+
+	field = strings.TrimSpace(field)
+	values := strings.Split(strings.TrimSpace(term[equalIndex+1:]), "|")
+
+	var filter SpanFilter
+	switch {
+	case field == "name":
+		filters := make([]SpanFilter, len(values))
+		for i, value := range values {
+			filters[i] = FilterSpanName(value)
+		}
+		filter = FilterAny(filters...)
+
+	case field == "status":
+		filters := make([]SpanFilter, len(values))
+		for i, value := range values {
+			statusFilter, err := parseStatusFilter(value)
+			if err != nil {
+				return nil, err
+			}
+			filters[i] = statusFilter
+		}
+		filter = FilterAny(filters...)
+
+	case field == "kind":
+		kinds := make([]int, len(values))
+		for i, value := range values {
+			if value != "unspecified" && parseSpanKindName(value) == trace.SpanKindUnspecified {
+				return nil, fmt.Errorf("unknown span kind %q", value)
+			}
+			kinds[i] = parseSpanKindName(value)
+		}
+		filter = FilterSpanKind(kinds...)
+
+	case field == "min_duration":
+		if negated || len(values) > 1 {
+			return nil, fmt.Errorf("min_duration accepts a single value and cannot be negated")
+		}
+
+		duration, err := time.ParseDuration(values[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration: %s", err)
+		}
+		filter = FilterMinDuration(duration)
+
+	case strings.HasPrefix(field, "attr.") && len(field) > len("attr."):
+		filters := make([]SpanFilter, len(values))
+		for i, value := range values {
+			filters[i] = FilterAttribute(strings.TrimPrefix(field, "attr."), value)
+		}
+		filter = FilterAny(filters...)
+
+	default:
+		return nil, fmt.Errorf("unknown field %q", field)
+	}
+
+	if negated {
+		return FilterNot(filter), nil
+	}
+
+	return filter, nil
+}
+
+func parseStatusFilter(value string) (SpanFilter, error) {
+	if strings.EqualFold(value, "error") {
+		return FilterErrors(), nil
+	}
+
+	if code, err := strconv.ParseInt(value, 10, 32); err == nil {
+		return FilterStatusCode(int32(code)), nil
+	}
+
+	normalized := strings.ToLower(strings.Replace(value, "_", "", -1))
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		if strings.ToLower(code.String()) == normalized {
+			return FilterStatusCode(int32(code)), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown status %q", value)
+}
+
+// FanOutRoute sends the spans matched by `Filter` (all spans if nil) to `Exporter`.
+type FanOutRoute struct {
+	Exporter trace.Exporter
+	Filter   SpanFilter
+}
+
+// RouteSpans returns a route sending to `exporter` the spans matched by all `filters`,
+// or all spans if there are no filters.
+func RouteSpans(exporter trace.Exporter, filters ...SpanFilter) FanOutRoute {
+	route := FanOutRoute{Exporter: exporter}
+	if len(filters) > 0 {
+		route.Filter = FilterAll(filters...)
+	}
+
+	return route
+}
+
+// RouteSpansFromEnv returns a route sending to `exporter` the spans matched by the
+// filter expression (see `ParseSpanFilter`) found in the `TRACING_<NAME>_EXPORTER_FILTER`
+// environment variable, `<NAME>` being the upper-cased `name`. All spans are routed to
+// `exporter` when the variable is not set.
+func RouteSpansFromEnv(name string, exporter trace.Exporter) (FanOutRoute, error) {
+	envName := "TRACING_" + strings.ToUpper(name) + "_EXPORTER_FILTER"
+	expression := os.Getenv(envName)
+	if expression == "" {
+		return RouteSpans(exporter), nil
+	}
+
+	filter, err := ParseSpanFilter(expression)
+	if err != nil {
+		return FanOutRoute{}, fmt.Errorf("invalid %s: %s", envName, err)
+	}
+
+	return RouteSpans(exporter, filter), nil
+}
+
+// FanOutExporter is a `trace.Exporter` sending each span to the child exporters whose
+// route filter matches it, so that different destinations receive different subsets
+// of the spans, like all spans to Zipkin but only failed ones to the logs.
+type FanOutExporter struct {
+	routes []FanOutRoute
+}
+
+// Compile time assertion that the exporter implements trace.Exporter
+var _ trace.Exporter = (*FanOutExporter)(nil)
+
+// NewFanOutExporter returns an exporter dispatching spans to `routes`. Flushing and
+// closing the exporter flushes and closes the child exporters having a `Flush()` or
+// `Close() error` method.
+func NewFanOutExporter(routes ...FanOutRoute) *FanOutExporter {
+	return &FanOutExporter{routes: routes}
+}
+
+func (e *FanOutExporter) ExportSpan(span *trace.SpanData) {
+	for _, route := range e.routes {
+		if route.Filter == nil || route.Filter(span) {
+			route.Exporter.ExportSpan(span)
+		}
+	}
+}
+
+func (e *FanOutExporter) Flush() {
+	for _, route := range e.routes {
+		if f, ok := route.Exporter.(flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+func (e *FanOutExporter) Close() (err error) {
+	for _, route := range e.routes {
+		if c, ok := route.Exporter.(io.Closer); ok {
+			err = multierr.Append(err, c.Close())
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+)
+
+func TestParseSpanFilter(t *testing.T) {
+	now := time.Now()
+	span := &trace.SpanData{
+		Name:       "/api/users/1",
+		SpanKind:   trace.SpanKindServer,
+		Attributes: map[string]interface{}{"http.status_code": int64(404), "cached": true},
+		Status:     trace.Status{Code: trace.StatusCodeNotFound},
+		StartTime:  now,
+		EndTime:    now.Add(150 * time.Millisecond),
+	}
+
+	tests := []struct {
+		expression    string
+		expectedMatch bool
+		expectedError string
+	}{
+		{"", true, ""},
+		{"name=/api/*", true, ""},
+		{"name=/api/?", false, ""},
+		{"name!=/api/*", false, ""},
+		{"name=/health|/api/users/*", true, ""},
+		{"status=error", true, ""},
+		{"status=ok", false, ""},
+		{"status=NotFound", true, ""},
+		{"status=not_found", true, ""},
+		{"status=5", true, ""},
+		{"status!=ok", true, ""},
+		{"kind=server", true, ""},
+		{"kind=client|unspecified", false, ""},
+		{"min_duration=100ms", true, ""},
+		{"min_duration=1s", false, ""},
+		{"attr.http.status_code=404", true, ""},
+		{"attr.cached=true", true, ""},
+		{"attr.missing=true", false, ""},
+		{" name=/api/* , status=error ", true, ""},
+		{"name=/api/*,kind=client", false, ""},
+
+		{"name", false, `invalid filter term "name": expected field=value or field!=value`},
+		{"unknown=1", false, `invalid filter term "unknown=1": unknown field "unknown"`},
+		{"status=broken", false, `invalid filter term "status=broken": unknown status "broken"`},
+		{"kind=internal", false, `invalid filter term "kind=internal": unknown span kind "internal"`},
+		{"min_duration!=1s", false, `invalid filter term "min_duration!=1s": min_duration accepts a single value and cannot be negated`},
+		{"min_duration=fast", false, `invalid filter term "min_duration=fast": invalid duration: time: invalid duration "fast"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			filter, err := ParseSpanFilter(test.expression)
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedMatch, filter(span))
+		})
+	}
+}
+
+func TestFanOutExporter(t *testing.T) {
+	os.Setenv("TRACING_ERRORS_EXPORTER_FILTER", "status=error")
+	defer os.Unsetenv("TRACING_ERRORS_EXPORTER_FILTER")
+
+	all := &capturingExporter{}
+	errors := &capturingExporter{}
+	servers := &capturingExporter{}
+
+	errorsRoute, err := RouteSpansFromEnv("errors", errors)
+	require.NoError(t, err)
+
+	exporter := NewFanOutExporter(
+		RouteSpans(all),
+		errorsRoute,
+		RouteSpans(servers, FilterSpanKind(trace.SpanKindServer), FilterNot(FilterSpanName("*health*"))),
+	)
+
+	exporter.ExportSpan(&trace.SpanData{Name: "ok", SpanKind: trace.SpanKindServer})
+	exporter.ExportSpan(&trace.SpanData{Name: "failed", Status: trace.Status{Code: trace.StatusCodeInternal}})
+	exporter.ExportSpan(&trace.SpanData{Name: "/healthz", SpanKind: trace.SpanKindServer})
+
+	assert.Equal(t, []string{"ok", "failed", "/healthz"}, spanNames(all.spans))
+	assert.Equal(t, []string{"failed"}, spanNames(errors.spans))
+	assert.Equal(t, []string{"ok"}, spanNames(servers.spans))
+
+	os.Setenv("TRACING_ERRORS_EXPORTER_FILTER", "status=nope")
+	_, err = RouteSpansFromEnv("errors", errors)
+	assert.EqualError(t, err, `invalid TRACING_ERRORS_EXPORTER_FILTER: invalid filter term "status=nope": unknown status "nope"`)
+}
+
+func spanNames(spans []*trace.SpanData) (names []string) {
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+
+	return names
+}
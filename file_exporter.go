@@ -0,0 +1,589 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+const rotatedFileTimeFormat = "20060102T150405.000"
+
+// renameFile is replaced in tests to simulate rotation failures.
+var renameFile = os.Rename
+
+// FileOption configures the exporter returned by `NewFileExporter`.
+type FileOption func(exporter *FileExporter)
+
+// WithFileMaxSize rotates the file once `maxSize` bytes (uncompressed) have been written
+// to it, the rotated file being renamed with its rotation time inserted before its
+// extension (`spans.jsonl` becomes `spans-20200101T000000.000.jsonl`). No rotation
+// happens by default. With `WithFileGzip`, the content of an existing file is not
+// counted since only its compressed size is known.
+func WithFileMaxSize(maxSize int64) FileOption {
+	return func(exporter *FileExporter) {
+		exporter.maxSize = maxSize
+	}
+}
+
+// WithFileGzip compresses the written file(s) with gzip, the path should then end with `.gz`.
+func WithFileGzip() FileOption {
+	return func(exporter *FileExporter) {
+		exporter.gzip = true
+	}
+}
+
+// RegisterFileExporter registers an exporter writing every span to the file at `path`,
+// see `NewFileExporter`.
+//
+// The returned ShutdownFunc unregisters the exporter, flushes and closes the file.
+func RegisterFileExporter(path string, options ...FileOption) (ShutdownFunc, error) {
+	exporter, err := NewFileExporter(path, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return registerExporter(exporter), nil
+}
+
+// FileExporter is a `trace.Exporter` writing spans to a file in JSON Lines format, one
+// JSON object per span, which can be read back using `ReadSpans` or `ReplaySpansFile`.
+type FileExporter struct {
+	path    string
+	maxSize int64
+	gzip    bool
+
+	lock       sync.Mutex
+	file       *os.File
+	gzipWriter *gzip.Writer
+	writer     *bufio.Writer
+	written    int64
+	closed     bool
+}
+
+// Compile time assertion that the exporter implements trace.Exporter
+var _ trace.Exporter = (*FileExporter)(nil)
+
+// NewFileExporter returns an exporter appending spans to the file at `path`, created if
+// it does not exist.
+func NewFileExporter(path string, options ...FileOption) (*FileExporter, error) {
+	exporter := &FileExporter{path: path}
+	for _, option := range options {
+		option(exporter)
+	}
+
+	if err := exporter.open(); err != nil {
+		return nil, err
+	}
+
+	return exporter, nil
+}
+
+func (e *FileExporter) open() error {
+	file, err := os.OpenFile(e.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open spans file: %s", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to stat spans file: %s", err)
+	}
+
+	e.file = file
+	e.written = info.Size()
+	if e.gzip {
+		// The size on disk is compressed, only count the uncompressed bytes written
+		// from now on
+		e.written = 0
+	}
+
+	var out io.Writer = file
+	if e.gzip {
+		// Appending a new gzip member to an existing gzip file is valid, readers see
+		// the concatenation of all members.
+		e.gzipWriter = gzip.NewWriter(file)
+		out = e.gzipWriter
+	}
+
+	e.writer = bufio.NewWriter(out)
+	return nil
+}
+
+func (e *FileExporter) ExportSpan(span *trace.SpanData) {
+	line, err := json.Marshal(toFileSpan(span))
+	if err != nil {
+		zlog.Warn("unable to marshal span", zap.String("name", span.Name), zap.Error(err))
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return
+	}
+
+	if e.writer == nil {
+		// A previous rotation failed to reopen the file
+		if err := e.open(); err != nil {
+			zlog.Warn("unable to reopen spans file", zap.String("path", e.path), zap.Error(err))
+			return
+		}
+	}
+
+	if e.maxSize > 0 && e.written > 0 && e.written+int64(len(line))+1 > e.maxSize {
+		if err := e.rotate(); err != nil {
+			zlog.Warn("unable to rotate spans file", zap.String("path", e.path), zap.Error(err))
+			if e.writer == nil {
+				return
+			}
+		}
+	}
+
+	if _, err := e.writer.Write(line); err != nil {
+		zlog.Warn("unable to write span", zap.String("path", e.path), zap.Error(err))
+		return
+	}
+
+	if err := e.writer.WriteByte('\n'); err != nil {
+		zlog.Warn("unable to write span", zap.String("path", e.path), zap.Error(err))
+		return
+	}
+
+	e.written += int64(len(line)) + 1
+}
+
+// rotate must be called with the lock held. When the file cannot be renamed, spans keep
+// being appended to it, rotation being attempted again once `maxSize` more bytes have
+// been written.
+func (e *FileExporter) rotate() error {
+	err := e.close()
+	if err == nil {
+		err = renameFile(e.path, rotatedFilePath(e.path, time.Now()))
+	}
+
+	if openErr := e.open(); openErr != nil {
+		return multierr.Append(err, openErr)
+	}
+
+	if err != nil {
+		e.written = 0
+	}
+
+	return err
+}
+
+// rotatedFilePath inserts the time before the extension(s) of the file name, adding a
+// sequence number when a file rotated at the same time already exists.
+func rotatedFilePath(path string, now time.Time) string {
+	dir, name := filepath.Split(path)
+	base, extension := name, ""
+	if dotIndex := strings.Index(name, "."); dotIndex > 0 {
+		base, extension = name[:dotIndex], name[dotIndex:]
+	}
+
+	rotatedBase := base + "-" + now.UTC().Format(rotatedFileTimeFormat)
+	rotatedPath := filepath.Join(dir, rotatedBase+extension)
+	for i := 1; fileExists(rotatedPath); i++ {
+		rotatedPath = filepath.Join(dir, fmt.Sprintf("%s-%d%s", rotatedBase, i, extension))
+	}
+
+	return rotatedPath
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Flush writes buffered spans to the file.
+func (e *FileExporter) Flush() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if err := e.flush(); err != nil {
+		zlog.Warn("unable to flush spans file", zap.String("path", e.path), zap.Error(err))
+	}
+}
+
+func (e *FileExporter) flush() error {
+	if e.writer == nil {
+		return nil
+	}
+
+	if err := e.writer.Flush(); err != nil {
+		return err
+	}
+
+	if e.gzipWriter != nil {
+		return e.gzipWriter.Flush()
+	}
+
+	return nil
+}
+
+// Close flushes buffered spans and closes the file, spans exported afterwards are dropped.
+func (e *FileExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.closed = true
+	return e.close()
+}
+
+func (e *FileExporter) close() (err error) {
+	if e.writer == nil {
+		return nil
+	}
+
+	err = e.writer.Flush()
+	if e.gzipWriter != nil {
+		err = multierr.Append(err, e.gzipWriter.Close())
+	}
+
+	err = multierr.Append(err, e.file.Close())
+	e.file, e.gzipWriter, e.writer = nil, nil, nil
+
+	return err
+}
+
+// ReadSpans reads spans written by the file exporter from `reader`, gzip compressed or
+// not, calling `fn` for each of them in order. Reading stops at the first error.
+func ReadSpans(reader io.Reader, fn func(span *trace.SpanData) error) error {
+	buffered := bufio.NewReader(reader)
+
+	var in io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("unable to read gzip spans: %s", err)
+		}
+		defer gzipReader.Close()
+
+		in = gzipReader
+	}
+
+	decoder := json.NewDecoder(in)
+	for i := 0; ; i++ {
+		var span fileSpan
+		if err := decoder.Decode(&span); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return fmt.Errorf("unable to decode span #%d: %s", i, err)
+		}
+
+		spanData, err := span.toSpanData()
+		if err != nil {
+			return fmt.Errorf("invalid span #%d: %s", i, err)
+		}
+
+		if err := fn(spanData); err != nil {
+			return err
+		}
+	}
+}
+
+// ReplaySpansFile reads the spans of the file at `path` (see `ReadSpans`) and exports
+// each of them to all `exporters`, returning the number of spans replayed. Exporters
+// are not flushed, it's up to the caller to do it.
+func ReplaySpansFile(path string, exporters ...trace.Exporter) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open spans file: %s", err)
+	}
+	defer file.Close()
+
+	count := 0
+	err = ReadSpans(file, func(span *trace.SpanData) error {
+		for _, exporter := range exporters {
+			exporter.ExportSpan(span)
+		}
+
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+// fileSpan is the JSON representation of a `trace.SpanData`.
+type fileSpan struct {
+	TraceID         string             `json:"trace_id"`
+	SpanID          string             `json:"span_id"`
+	ParentSpanID    string             `json:"parent_span_id,omitempty"`
+	Sampled         bool               `json:"sampled"`
+	Tracestate      string             `json:"tracestate,omitempty"`
+	HasRemoteParent bool               `json:"has_remote_parent,omitempty"`
+	Name            string             `json:"name"`
+	Kind            string             `json:"kind"`
+	StartTime       time.Time          `json:"start_time"`
+	EndTime         time.Time          `json:"end_time"`
+	StatusCode      int32              `json:"status_code"`
+	StatusMessage   string             `json:"status_message,omitempty"`
+	Attributes      fileAttributes     `json:"attributes,omitempty"`
+	Annotations     []fileAnnotation   `json:"annotations,omitempty"`
+	MessageEvents   []fileMessageEvent `json:"message_events,omitempty"`
+	Links           []fileLink         `json:"links,omitempty"`
+	ChildSpanCount  int                `json:"child_span_count,omitempty"`
+	DroppedCounts   map[string]int     `json:"dropped_counts,omitempty"`
+}
+
+type fileAnnotation struct {
+	Time       time.Time      `json:"time"`
+	Message    string         `json:"message"`
+	Attributes fileAttributes `json:"attributes,omitempty"`
+}
+
+type fileMessageEvent struct {
+	Time             time.Time `json:"time"`
+	Type             string    `json:"type"`
+	ID               int64     `json:"id"`
+	UncompressedSize int64     `json:"uncompressed_size"`
+	CompressedSize   int64     `json:"compressed_size"`
+}
+
+type fileLink struct {
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	Type       string         `json:"type"`
+	Attributes fileAttributes `json:"attributes,omitempty"`
+}
+
+// fileAttributes keeps the type of attribute values, which JSON alone would lose for
+// integers.
+type fileAttributes map[string]fileAttributeValue
+
+type fileAttributeValue struct {
+	String *string  `json:"string,omitempty"`
+	Int    *int64   `json:"int,omitempty,string"`
+	Bool   *bool    `json:"bool,omitempty"`
+	Double *float64 `json:"double,omitempty"`
+}
+
+func toFileSpan(span *trace.SpanData) *fileSpan {
+	out := &fileSpan{
+		TraceID:         span.TraceID.String(),
+		SpanID:          span.SpanID.String(),
+		Sampled:         span.IsSampled(),
+		Tracestate:      formatTracestate(span.Tracestate),
+		HasRemoteParent: span.HasRemoteParent,
+		Name:            span.Name,
+		Kind:            spanKindName(span.SpanKind),
+		StartTime:       span.StartTime,
+		EndTime:         span.EndTime,
+		StatusCode:      span.Code,
+		StatusMessage:   span.Message,
+		Attributes:      toFileAttributes(span.Attributes),
+		ChildSpanCount:  span.ChildSpanCount,
+	}
+
+	if span.ParentSpanID != (trace.SpanID{}) {
+		out.ParentSpanID = span.ParentSpanID.String()
+	}
+
+	for _, annotation := range span.Annotations {
+		out.Annotations = append(out.Annotations, fileAnnotation{annotation.Time, annotation.Message, toFileAttributes(annotation.Attributes)})
+	}
+
+	for _, event := range span.MessageEvents {
+		out.MessageEvents = append(out.MessageEvents, fileMessageEvent{event.Time, messageEventTypeName(event.EventType), event.MessageID, event.UncompressedByteSize, event.CompressedByteSize})
+	}
+
+	for _, link := range span.Links {
+		out.Links = append(out.Links, fileLink{link.TraceID.String(), link.SpanID.String(), linkTypeName(link.Type), toFileAttributes(link.Attributes)})
+	}
+
+	for name, count := range map[string]int{
+		"attributes":     span.DroppedAttributeCount,
+		"annotations":    span.DroppedAnnotationCount,
+		"message_events": span.DroppedMessageEventCount,
+		"links":          span.DroppedLinkCount,
+	} {
+		if count > 0 {
+			if out.DroppedCounts == nil {
+				out.DroppedCounts = map[string]int{}
+			}
+
+			out.DroppedCounts[name] = count
+		}
+	}
+
+	return out
+}
+
+func toFileAttributes(attributes map[string]interface{}) fileAttributes {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	out := make(fileAttributes, len(attributes))
+	for key, value := range attributes {
+		switch v := value.(type) {
+		case bool:
+			out[key] = fileAttributeValue{Bool: &v}
+		case int64:
+			out[key] = fileAttributeValue{Int: &v}
+		case float64:
+			out[key] = fileAttributeValue{Double: &v}
+		case string:
+			out[key] = fileAttributeValue{String: &v}
+		default:
+			s := fmt.Sprintf("%v", v)
+			out[key] = fileAttributeValue{String: &s}
+		}
+	}
+
+	return out
+}
+
+func (s *fileSpan) toSpanData() (*trace.SpanData, error) {
+	out := &trace.SpanData{
+		Name:                     s.Name,
+		SpanKind:                 parseSpanKindName(s.Kind),
+		StartTime:                s.StartTime,
+		EndTime:                  s.EndTime,
+		Status:                   trace.Status{Code: s.StatusCode, Message: s.StatusMessage},
+		Attributes:               s.Attributes.toAttributes(),
+		HasRemoteParent:          s.HasRemoteParent,
+		ChildSpanCount:           s.ChildSpanCount,
+		DroppedAttributeCount:    s.DroppedCounts["attributes"],
+		DroppedAnnotationCount:   s.DroppedCounts["annotations"],
+		DroppedMessageEventCount: s.DroppedCounts["message_events"],
+		DroppedLinkCount:         s.DroppedCounts["links"],
+	}
+
+	var err error
+	if out.TraceID, err = ParseTraceID(s.TraceID); err != nil {
+		return nil, err
+	}
+
+	if out.SpanID, err = ParseSpanID(s.SpanID); err != nil {
+		return nil, err
+	}
+
+	if s.ParentSpanID != "" {
+		if out.ParentSpanID, err = ParseSpanID(s.ParentSpanID); err != nil {
+			return nil, fmt.Errorf("invalid parent: %s", err)
+		}
+	}
+
+	if s.Sampled {
+		out.TraceOptions = 1
+	}
+
+	if s.Tracestate != "" {
+		out.Tracestate = parseTracestate([]string{s.Tracestate})
+	}
+
+	for _, annotation := range s.Annotations {
+		out.Annotations = append(out.Annotations, trace.Annotation{Time: annotation.Time, Message: annotation.Message, Attributes: annotation.Attributes.toAttributes()})
+	}
+
+	for _, event := range s.MessageEvents {
+		out.MessageEvents = append(out.MessageEvents, trace.MessageEvent{
+			Time:                 event.Time,
+			EventType:            parseMessageEventTypeName(event.Type),
+			MessageID:            event.ID,
+			UncompressedByteSize: event.UncompressedSize,
+			CompressedByteSize:   event.CompressedSize,
+		})
+	}
+
+	for _, fileLink := range s.Links {
+		link := trace.Link{Type: parseLinkTypeName(fileLink.Type), Attributes: fileLink.Attributes.toAttributes()}
+		if link.TraceID, err = ParseTraceID(fileLink.TraceID); err != nil {
+			return nil, fmt.Errorf("invalid link: %s", err)
+		}
+
+		if link.SpanID, err = ParseSpanID(fileLink.SpanID); err != nil {
+			return nil, fmt.Errorf("invalid link: %s", err)
+		}
+
+		out.Links = append(out.Links, link)
+	}
+
+	return out, nil
+}
+
+func (a fileAttributes) toAttributes() map[string]interface{} {
+	if len(a) == 0 {
+		return nil
+	}
+
+	out := make(map[string]interface{}, len(a))
+	for key, value := range a {
+		switch {
+		case value.Bool != nil:
+			out[key] = *value.Bool
+		case value.Int != nil:
+			out[key] = *value.Int
+		case value.Double != nil:
+			out[key] = *value.Double
+		case value.String != nil:
+			out[key] = *value.String
+		}
+	}
+
+	return out
+}
+
+func parseSpanKindName(name string) int {
+	switch name {
+	case "server":
+		return trace.SpanKindServer
+	case "client":
+		return trace.SpanKindClient
+	default:
+		return trace.SpanKindUnspecified
+	}
+}
+
+func parseMessageEventTypeName(name string) trace.MessageEventType {
+	switch name {
+	case "SENT":
+		return trace.MessageEventTypeSent
+	case "RECEIVED":
+		return trace.MessageEventTypeRecv
+	default:
+		return trace.MessageEventTypeUnspecified
+	}
+}
+
+func parseLinkTypeName(name string) trace.LinkType {
+	switch name {
+	case "child":
+		return trace.LinkTypeChild
+	case "parent":
+		return trace.LinkTypeParent
+	default:
+		return trace.LinkTypeUnspecified
+	}
+}
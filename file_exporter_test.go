@@ -0,0 +1,145 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/tracestate"
+)
+
+func TestFileExporter(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gzip %t", compressed), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "spans.jsonl")
+
+			options := []FileOption{WithFileMaxSize(2048)}
+			if compressed {
+				path += ".gz"
+				options = append(options, WithFileGzip())
+			}
+
+			exporter, err := NewFileExporter(path, options...)
+			require.NoError(t, err)
+
+			var expected []*trace.SpanData
+			for i := 0; i < 10; i++ {
+				span := testFileSpanData(i)
+				exporter.ExportSpan(span)
+				expected = append(expected, span)
+			}
+			require.NoError(t, exporter.Close())
+
+			files, err := filepath.Glob(filepath.Join(dir, "spans*"))
+			require.NoError(t, err)
+			assert.Greater(t, len(files), 1, "expected rotated files")
+
+			recorder := &capturingExporter{}
+			total := 0
+			for _, file := range files {
+				count, err := ReplaySpansFile(file, recorder)
+				require.NoError(t, err)
+				total += count
+			}
+
+			assert.Equal(t, 10, total)
+			assert.ElementsMatch(t, expected, recorder.spans)
+		})
+	}
+}
+
+func TestFileExporter_RotationFailure(t *testing.T) {
+	renameFile = func(oldPath, newPath string) error { return errors.New("rename failed") }
+	defer func() { renameFile = os.Rename }()
+
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	exporter, err := NewFileExporter(path, WithFileMaxSize(1))
+	require.NoError(t, err)
+
+	var expected []*trace.SpanData
+	for i := 0; i < 3; i++ {
+		span := testFileSpanData(i)
+		exporter.ExportSpan(span)
+		expected = append(expected, span)
+	}
+	require.NoError(t, exporter.Close())
+
+	recorder := &capturingExporter{}
+	count, err := ReplaySpansFile(path, recorder)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count, "spans are appended to the current file when rotation fails")
+	assert.Equal(t, expected, recorder.spans)
+}
+
+func TestFileExporter_GzipExistingFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl.gz")
+
+	exporter, err := NewFileExporter(path, WithFileGzip())
+	require.NoError(t, err)
+	exporter.ExportSpan(testFileSpanData(0))
+	require.NoError(t, exporter.Close())
+
+	exporter, err = NewFileExporter(path, WithFileGzip())
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	assert.Equal(t, int64(0), exporter.written, "compressed size on disk is not counted")
+}
+
+func TestReplaySpansFile_Invalid(t *testing.T) {
+	_, err := ReplaySpansFile(filepath.Join(t.TempDir(), "missing.jsonl"))
+	assert.Error(t, err)
+}
+
+func testFileSpanData(i int) *trace.SpanData {
+	start := time.Date(2020, 1, 1, 0, 0, i, 0, time.UTC)
+	ts, _ := tracestate.New(nil, tracestate.Entry{Key: "vendor", Value: "value"})
+
+	return &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID:      NewFixedTraceID("0000000000000000000000000000000a"),
+			SpanID:       trace.SpanID{byte(i + 1)},
+			TraceOptions: 1,
+			Tracestate:   ts,
+		},
+		ParentSpanID: trace.SpanID{0xff},
+		SpanKind:     trace.SpanKindClient,
+		Name:         fmt.Sprintf("span-%d", i),
+		StartTime:    start,
+		EndTime:      start.Add(time.Millisecond),
+		Attributes:   map[string]interface{}{"int": int64(i), "string": "value", "bool": true, "float": 1.5},
+		Annotations: []trace.Annotation{
+			{Time: start, Message: "annotated", Attributes: map[string]interface{}{"big": int64(1) << 60}},
+		},
+		MessageEvents: []trace.MessageEvent{
+			{Time: start, EventType: trace.MessageEventTypeRecv, MessageID: 1, UncompressedByteSize: 10, CompressedByteSize: 5},
+		},
+		Links: []trace.Link{
+			{TraceID: NewFixedTraceID("0000000000000000000000000000000b"), SpanID: trace.SpanID{2}, Type: trace.LinkTypeParent},
+		},
+		Status:                trace.Status{Code: trace.StatusCodeInternal, Message: "failed"},
+		ChildSpanCount:        2,
+		DroppedAttributeCount: 3,
+	}
+}
@@ -3,11 +3,20 @@ module github.com/streamingfast/dtracing
 go 1.16
 
 require (
+	cloud.google.com/go/trace v1.0.0
 	contrib.go.opencensus.io/exporter/stackdriver v0.13.10
 	contrib.go.opencensus.io/exporter/zipkin v0.1.1
 	github.com/openzipkin/zipkin-go v0.1.6
 	github.com/streamingfast/logging v0.0.0-20220304183711-ddba33d79e27
 	github.com/stretchr/testify v1.6.1
+	github.com/uber/jaeger-client-go v2.25.0+incompatible
 	go.opencensus.io v0.23.0
+	go.opentelemetry.io/proto/otlp v0.9.0
+	go.uber.org/multierr v1.3.0
 	go.uber.org/zap v1.14.0
+	golang.org/x/oauth2 v0.0.0-20211005180243-6b3c2da341f1
+	google.golang.org/api v0.59.0
+	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,354 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	grpcTraceBinMetadataKey = "grpc-trace-bin"
+
+	rpcSystemAttribute           = "rpc.system"
+	rpcServiceAttribute          = "rpc.service"
+	rpcMethodAttribute           = "rpc.method"
+	rpcStatusCodeAttribute       = "rpc.grpc.status_code"
+	rpcMessagesSentAttribute     = "rpc.messages_sent"
+	rpcMessagesReceivedAttribute = "rpc.messages_received"
+)
+
+// GRPCOption configures the gRPC interceptors.
+type GRPCOption func(config *grpcConfig)
+
+type grpcConfig struct {
+	sampler       trace.Sampler
+	messageEvents bool
+}
+
+// WithGRPCSampler sets the sampler used for the spans started by the interceptors, the
+// default sampler is used otherwise.
+func WithGRPCSampler(sampler trace.Sampler) GRPCOption {
+	return func(config *grpcConfig) {
+		config.sampler = sampler
+	}
+}
+
+// WithGRPCMessageEvents records a message event on the span for each message sent and
+// received by streaming calls.
+func WithGRPCMessageEvents() GRPCOption {
+	return func(config *grpcConfig) {
+		config.messageEvents = true
+	}
+}
+
+func newGRPCConfig(options []GRPCOption) *grpcConfig {
+	config := &grpcConfig{}
+	for _, option := range options {
+		option(config)
+	}
+
+	return config
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor that starts a server span, named after
+// the full method, for every unary call. The span context found in the incoming metadata
+// (either `traceparent` or `grpc-trace-bin`) is used as the remote parent.
+//
+// Like `NewAddTraceIDAwareLoggerMiddleware`, a `zap.Logger` is attached to the call's
+// context (extractable using `logging.Logger(ctx, <fallbackLogger>)`), instrumented with
+// the `trace_id`, `span_id` and `trace_sampled` fields of the started span (see `Logger`).
+func UnaryServerInterceptor(rootLogger *zap.Logger, options ...GRPCOption) grpc.UnaryServerInterceptor {
+	if rootLogger == nil {
+		panic("root logger must not be nil")
+	}
+
+	config := newGRPCConfig(options)
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, span := startGRPCServerSpan(ctx, info.FullMethod, rootLogger, config)
+		defer span.End()
+
+		resp, err := handler(ctx, req)
+		setGRPCSpanStatus(span, err)
+
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor is the streaming counterpart of `UnaryServerInterceptor`, the
+// span also records the number of messages sent and received.
+func StreamServerInterceptor(rootLogger *zap.Logger, options ...GRPCOption) grpc.StreamServerInterceptor {
+	if rootLogger == nil {
+		panic("root logger must not be nil")
+	}
+
+	config := newGRPCConfig(options)
+
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := startGRPCServerSpan(stream.Context(), info.FullMethod, rootLogger, config)
+		defer span.End()
+
+		tracedStream := &tracedServerStream{ServerStream: stream, ctx: ctx, counter: &messageCounter{span: span, events: config.messageEvents}}
+		err := handler(srv, tracedStream)
+
+		tracedStream.counter.addAttributes()
+		setGRPCSpanStatus(span, err)
+
+		return err
+	}
+}
+
+// UnaryClientInterceptor returns a gRPC interceptor that starts a client span, named after
+// the full method, for every unary call and injects its span context in the outgoing
+// metadata (both `traceparent` and `grpc-trace-bin`).
+func UnaryClientInterceptor(options ...GRPCOption) grpc.UnaryClientInterceptor {
+	config := newGRPCConfig(options)
+
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, span := startGRPCClientSpan(ctx, method, config)
+		defer span.End()
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		setGRPCSpanStatus(span, err)
+
+		return err
+	}
+}
+
+// StreamClientInterceptor is the streaming counterpart of `UnaryClientInterceptor`, the
+// span also records the number of messages sent and received and ends when the stream
+// is done receiving, that is after the single response of client-streaming calls.
+func StreamClientInterceptor(options ...GRPCOption) grpc.StreamClientInterceptor {
+	config := newGRPCConfig(options)
+
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, span := startGRPCClientSpan(ctx, method, config)
+
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			setGRPCSpanStatus(span, err)
+			span.End()
+			return nil, err
+		}
+
+		return &tracedClientStream{ClientStream: stream, desc: desc, span: span, counter: &messageCounter{span: span, events: config.messageEvents}}, nil
+	}
+}
+
+func startGRPCServerSpan(ctx context.Context, fullMethod string, rootLogger *zap.Logger, config *grpcConfig) (context.Context, *trace.Span) {
+	name := strings.TrimPrefix(fullMethod, "/")
+	startOptions := []trace.StartOption{trace.WithSpanKind(trace.SpanKindServer)}
+	if config.sampler != nil {
+		startOptions = append(startOptions, trace.WithSampler(config.sampler))
+	}
+
+	var span *trace.Span
+	if remoteSpanContext, ok := spanContextFromIncomingMetadata(ctx); ok {
+		ctx, span = trace.StartSpanWithRemoteParent(ctx, name, remoteSpanContext, startOptions...)
+	} else {
+		ctx, span = trace.StartSpan(ctx, name, startOptions...)
+	}
+
+	span.AddAttributes(grpcMethodAttributes(name)...)
+
+	return withEnrichedLogger(ctx, rootLogger, span), span
+}
+
+func startGRPCClientSpan(ctx context.Context, fullMethod string, config *grpcConfig) (context.Context, *trace.Span) {
+	name := strings.TrimPrefix(fullMethod, "/")
+	startOptions := []trace.StartOption{trace.WithSpanKind(trace.SpanKindClient)}
+	if config.sampler != nil {
+		startOptions = append(startOptions, trace.WithSampler(config.sampler))
+	}
+
+	ctx, span := trace.StartSpan(ctx, name, startOptions...)
+	span.AddAttributes(grpcMethodAttributes(name)...)
+
+	spanContext := span.SpanContext()
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		traceparentHeader, FormatTraceparent(spanContext),
+		grpcTraceBinMetadataKey, string(propagation.Binary(spanContext)),
+	)
+
+	return ctx, span
+}
+
+func spanContextFromIncomingMetadata(ctx context.Context) (trace.SpanContext, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+
+	if values := md.Get(traceparentHeader); len(values) > 0 {
+		if sc, ok := parseTraceparent(values[0]); ok {
+			sc.Tracestate = parseTracestate(md.Get(tracestateHeader))
+			return sc, true
+		}
+	}
+
+	if values := md.Get(grpcTraceBinMetadataKey); len(values) > 0 {
+		return propagation.FromBinary([]byte(values[0]))
+	}
+
+	return trace.SpanContext{}, false
+}
+
+func grpcMethodAttributes(name string) []trace.Attribute {
+	attributes := []trace.Attribute{trace.StringAttribute(rpcSystemAttribute, "grpc")}
+	if slashIndex := strings.LastIndex(name, "/"); slashIndex >= 0 {
+		attributes = append(attributes,
+			trace.StringAttribute(rpcServiceAttribute, name[:slashIndex]),
+			trace.StringAttribute(rpcMethodAttribute, name[slashIndex+1:]),
+		)
+	}
+
+	return attributes
+}
+
+// setGRPCSpanStatus sets the span status from the gRPC status of `err`, gRPC codes
+// being the same as OpenCensus status codes.
+func setGRPCSpanStatus(span *trace.Span, err error) {
+	s := status.Convert(err)
+	span.AddAttributes(trace.Int64Attribute(rpcStatusCodeAttribute, int64(s.Code())))
+	span.SetStatus(trace.Status{Code: int32(s.Code()), Message: s.Message()})
+}
+
+// messageCounter counts messages of a stream, recording a message event for each
+// one of them when `events` is true.
+type messageCounter struct {
+	span     *trace.Span
+	events   bool
+	sent     int64
+	received int64
+}
+
+func (c *messageCounter) onSend(msg interface{}) {
+	id := atomic.AddInt64(&c.sent, 1)
+	if c.events {
+		size := int64(messageSize(msg))
+		c.span.AddMessageSendEvent(id, size, size)
+	}
+}
+
+func (c *messageCounter) onReceive(msg interface{}) {
+	id := atomic.AddInt64(&c.received, 1)
+	if c.events {
+		size := int64(messageSize(msg))
+		c.span.AddMessageReceiveEvent(id, size, size)
+	}
+}
+
+func (c *messageCounter) addAttributes() {
+	c.span.AddAttributes(
+		trace.Int64Attribute(rpcMessagesSentAttribute, atomic.LoadInt64(&c.sent)),
+		trace.Int64Attribute(rpcMessagesReceivedAttribute, atomic.LoadInt64(&c.received)),
+	)
+}
+
+func messageSize(msg interface{}) int {
+	if protoMsg, ok := msg.(proto.Message); ok {
+		return proto.Size(protoMsg)
+	}
+
+	return 0
+}
+
+type tracedServerStream struct {
+	grpc.ServerStream
+
+	ctx     context.Context
+	counter *messageCounter
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *tracedServerStream) SendMsg(msg interface{}) error {
+	err := s.ServerStream.SendMsg(msg)
+	if err == nil {
+		s.counter.onSend(msg)
+	}
+
+	return err
+}
+
+func (s *tracedServerStream) RecvMsg(msg interface{}) error {
+	err := s.ServerStream.RecvMsg(msg)
+	if err == nil {
+		s.counter.onReceive(msg)
+	}
+
+	return err
+}
+
+type tracedClientStream struct {
+	grpc.ClientStream
+
+	desc    *grpc.StreamDesc
+	span    *trace.Span
+	counter *messageCounter
+	endOnce sync.Once
+}
+
+func (s *tracedClientStream) SendMsg(msg interface{}) error {
+	err := s.ClientStream.SendMsg(msg)
+	if err == nil {
+		s.counter.onSend(msg)
+	} else if err != io.EOF {
+		// On io.EOF, the actual status is retrieved through RecvMsg
+		s.end(err)
+	}
+
+	return err
+}
+
+func (s *tracedClientStream) RecvMsg(msg interface{}) error {
+	err := s.ClientStream.RecvMsg(msg)
+	switch {
+	case err == nil:
+		s.counter.onReceive(msg)
+		if !s.desc.ServerStreams {
+			// Client-streaming calls receive a single response, no io.EOF follows it
+			s.end(nil)
+		}
+	case err == io.EOF:
+		s.end(nil)
+	default:
+		s.end(err)
+	}
+
+	return err
+}
+
+func (s *tracedClientStream) end(err error) {
+	s.endOnce.Do(func() {
+		s.counter.addAttributes()
+		setGRPCSpanStatus(s.span, err)
+		s.span.End()
+	})
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type loggingHealthServer struct {
+	*health.Server
+}
+
+func (s *loggingHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	logging.Logger(ctx, zlog).Info("checking")
+	return s.Server.Check(ctx, req)
+}
+
+// uploadServiceDesc describes a client-streaming service, the health messages being
+// reused as payloads.
+var uploadServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.Uploader",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Upload",
+		ClientStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			for {
+				err := stream.RecvMsg(&healthpb.HealthCheckRequest{})
+				if err == io.EOF {
+					return stream.SendMsg(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+				}
+
+				if err != nil {
+					return err
+				}
+			}
+		},
+	}},
+}
+
+func TestGRPCInterceptors(t *testing.T) {
+	exporter := &capturingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	core, logs := observer.New(zap.InfoLevel)
+	sampler := WithGRPCSampler(trace.AlwaysSample())
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(zap.New(core), sampler)),
+		grpc.StreamInterceptor(StreamServerInterceptor(zap.New(core), sampler, WithGRPCMessageEvents())),
+	)
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, &loggingHealthServer{healthServer})
+	server.RegisterService(&uploadServiceDesc, struct{}{})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor(sampler)),
+		grpc.WithStreamInterceptor(StreamClientInterceptor(sampler)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+
+	t.Run("unary", func(t *testing.T) {
+		exporter.spans = nil
+
+		_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+
+		_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "unknown"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+
+		require.Len(t, exporter.spans, 4)
+		serverSpan, clientSpan := exporter.spans[0], exporter.spans[1]
+
+		assert.Equal(t, "grpc.health.v1.Health/Check", serverSpan.Name)
+		assert.Equal(t, trace.SpanKindServer, serverSpan.SpanKind)
+		assert.Equal(t, trace.SpanKindClient, clientSpan.SpanKind)
+		assert.Equal(t, clientSpan.TraceID, serverSpan.TraceID)
+		assert.Equal(t, clientSpan.SpanID, serverSpan.ParentSpanID)
+		assert.True(t, serverSpan.HasRemoteParent)
+		assert.Equal(t, "grpc.health.v1.Health", serverSpan.Attributes["rpc.service"])
+		assert.Equal(t, "Check", serverSpan.Attributes["rpc.method"])
+		assert.Equal(t, int32(trace.StatusCodeOK), serverSpan.Code)
+
+		assert.Equal(t, int32(trace.StatusCodeNotFound), exporter.spans[2].Code)
+		assert.Equal(t, int32(trace.StatusCodeNotFound), exporter.spans[3].Code)
+
+		entries := logs.TakeAll()
+		require.Len(t, entries, 2)
+		assert.Equal(t, serverSpan.TraceID.String(), entries[0].ContextMap()["trace_id"])
+		assert.Equal(t, serverSpan.SpanID.String(), entries[0].ContextMap()["span_id"])
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		exporter.spans = nil
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+
+		_, err = stream.Recv()
+		require.NoError(t, err)
+
+		cancel()
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Canceled, status.Code(err))
+
+		require.Eventually(t, func() bool {
+			exporter.lock.Lock()
+			defer exporter.lock.Unlock()
+			return len(exporter.spans) == 2
+		}, time.Second, 5*time.Millisecond)
+
+		spans := map[int]*trace.SpanData{}
+		for _, span := range exporter.spans {
+			spans[span.SpanKind] = span
+		}
+
+		clientSpan := spans[trace.SpanKindClient]
+		assert.Equal(t, "grpc.health.v1.Health/Watch", clientSpan.Name)
+		assert.Equal(t, int64(1), clientSpan.Attributes["rpc.messages_received"])
+		assert.Equal(t, int32(trace.StatusCodeCancelled), clientSpan.Code)
+		assert.Empty(t, clientSpan.MessageEvents)
+
+		serverSpan := spans[trace.SpanKindServer]
+		assert.Equal(t, clientSpan.SpanID, serverSpan.ParentSpanID)
+		assert.Equal(t, int64(1), serverSpan.Attributes["rpc.messages_received"])
+		assert.Equal(t, int64(1), serverSpan.Attributes["rpc.messages_sent"])
+		require.Len(t, serverSpan.MessageEvents, 2)
+		assert.Equal(t, trace.MessageEventTypeRecv, serverSpan.MessageEvents[0].EventType)
+		assert.Equal(t, trace.MessageEventTypeSent, serverSpan.MessageEvents[1].EventType)
+	})
+	t.Run("client stream", func(t *testing.T) {
+		exporter.lock.Lock()
+		exporter.spans = nil
+		exporter.lock.Unlock()
+
+		stream, err := conn.NewStream(context.Background(), &uploadServiceDesc.Streams[0], "/test.Uploader/Upload")
+		require.NoError(t, err)
+
+		require.NoError(t, stream.SendMsg(&healthpb.HealthCheckRequest{Service: "first"}))
+		require.NoError(t, stream.SendMsg(&healthpb.HealthCheckRequest{Service: "second"}))
+		require.NoError(t, stream.CloseSend())
+
+		response := &healthpb.HealthCheckResponse{}
+		require.NoError(t, stream.RecvMsg(response))
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, response.Status)
+
+		require.Eventually(t, func() bool {
+			exporter.lock.Lock()
+			defer exporter.lock.Unlock()
+			return len(exporter.spans) == 2
+		}, time.Second, 5*time.Millisecond)
+
+		spans := map[int]*trace.SpanData{}
+		for _, span := range exporter.spans {
+			spans[span.SpanKind] = span
+		}
+
+		clientSpan := spans[trace.SpanKindClient]
+		require.NotNil(t, clientSpan, "client span must end after the single response")
+		assert.Equal(t, "test.Uploader/Upload", clientSpan.Name)
+		assert.Equal(t, int64(2), clientSpan.Attributes["rpc.messages_sent"])
+		assert.Equal(t, int64(1), clientSpan.Attributes["rpc.messages_received"])
+		assert.Equal(t, int32(trace.StatusCodeOK), clientSpan.Code)
+
+		serverSpan := spans[trace.SpanKindServer]
+		require.NotNil(t, serverSpan)
+		assert.Equal(t, clientSpan.SpanID, serverSpan.ParentSpanID)
+		assert.Equal(t, int64(2), serverSpan.Attributes["rpc.messages_received"])
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/trace"
+)
+
+// ParseTraceID parses a trace ID from any of the formats below, returning an error
+// instead of panicking like `NewFixedTraceID` does:
+//
+//   - 32 characters hexadecimal string (`4bf92f3577b34da6a3ce929d0e0e4736`)
+//   - 16 characters hexadecimal Jaeger/Zipkin short ID, left padded with zeros (`a3ce929d0e0e4736`)
+//   - StackDriver `X-Cloud-Trace-Context` header value (`4bf92f3577b34da6a3ce929d0e0e4736/1;o=1`)
+//   - W3C `traceparent` header value (`00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01`)
+func ParseTraceID(value string) (trace.TraceID, error) {
+	value = strings.TrimSpace(value)
+
+	switch {
+	case strings.Contains(value, "/"):
+		traceID, _, err := parseStackDriverHeader(value)
+		return traceID, err
+
+	case strings.Contains(value, "-"):
+		sc, ok := parseTraceparent(value)
+		if !ok {
+			return trace.TraceID{}, fmt.Errorf("invalid traceparent value %q", value)
+		}
+
+		return sc.TraceID, nil
+
+	case len(value) == 16:
+		value = strings.Repeat("0", 16) + value
+	}
+
+	traceID, ok := parseHexTraceID(value)
+	if !ok {
+		return trace.TraceID{}, fmt.Errorf("invalid trace id %q, expecting 32 or 16 hexadecimal characters", value)
+	}
+
+	return traceID, nil
+}
+
+// ParseSpanID parses a span ID from any of the formats below:
+//
+//   - 16 characters hexadecimal string (`00f067aa0ba902b7`)
+//   - StackDriver `X-Cloud-Trace-Context` header value, where the span ID is in decimal (`4bf92f3577b34da6a3ce929d0e0e4736/1;o=1`)
+//   - W3C `traceparent` header value (`00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01`)
+func ParseSpanID(value string) (trace.SpanID, error) {
+	value = strings.TrimSpace(value)
+
+	switch {
+	case strings.Contains(value, "/"):
+		_, spanID, err := parseStackDriverHeader(value)
+		return spanID, err
+
+	case strings.Contains(value, "-"):
+		sc, ok := parseTraceparent(value)
+		if !ok {
+			return trace.SpanID{}, fmt.Errorf("invalid traceparent value %q", value)
+		}
+
+		return sc.SpanID, nil
+	}
+
+	spanID, ok := parseHexSpanID(value)
+	if !ok {
+		return trace.SpanID{}, fmt.Errorf("invalid span id %q, expecting 16 hexadecimal characters", value)
+	}
+
+	return spanID, nil
+}
+
+// parseStackDriverHeader parses a `TRACE_ID/SPAN_ID;o=TRACE_TRUE` value, the span ID
+// being a decimal unsigned 64-bit integer and the options being optional.
+func parseStackDriverHeader(value string) (traceID trace.TraceID, spanID trace.SpanID, err error) {
+	slashIndex := strings.Index(value, "/")
+
+	var ok bool
+	if traceID, ok = parseHexTraceID(value[:slashIndex]); !ok {
+		return traceID, spanID, fmt.Errorf("invalid StackDriver value %q, trace id should have 32 hexadecimal characters", value)
+	}
+
+	spanPart := value[slashIndex+1:]
+	if semicolonIndex := strings.Index(spanPart, ";"); semicolonIndex >= 0 {
+		spanPart = spanPart[:semicolonIndex]
+	}
+
+	decimalSpanID, err := strconv.ParseUint(spanPart, 10, 64)
+	if err != nil {
+		return traceID, spanID, fmt.Errorf("invalid StackDriver value %q, span id should be a decimal unsigned integer: %s", value, err)
+	}
+
+	binary.BigEndian.PutUint64(spanID[:], decimalSpanID)
+	return traceID, spanID, nil
+}
+
+// FormatTraceIDHex returns the 32 characters hexadecimal representation of the trace ID.
+func FormatTraceIDHex(traceID trace.TraceID) string {
+	return hex.EncodeToString(traceID[:])
+}
+
+// FormatTraceIDShort returns the 16 characters hexadecimal representation of the lower
+// 64 bits of the trace ID, as used by Jaeger and Zipkin 64-bit trace IDs.
+func FormatTraceIDShort(traceID trace.TraceID) string {
+	return hex.EncodeToString(traceID[8:])
+}
+
+// FormatStackDriverHeader returns the StackDriver `X-Cloud-Trace-Context` header value
+// of the span context, `TRACE_ID/SPAN_ID;o=TRACE_TRUE`.
+func FormatStackDriverHeader(sc trace.SpanContext) string {
+	sampled := 0
+	if sc.IsSampled() {
+		sampled = 1
+	}
+
+	return fmt.Sprintf("%s/%d;o=%d", hex.EncodeToString(sc.TraceID[:]), binary.BigEndian.Uint64(sc.SpanID[:]), sampled)
+}
+
+// FormatTraceparent returns the W3C `traceparent` header value of the span context.
+func FormatTraceparent(sc trace.SpanContext) string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), uint32(sc.TraceOptions)&0x01)
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+)
+
+func TestParseTraceID(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          string
+		expected    string
+		expectedErr string
+	}{
+		{"hex", "4bf92f3577b34da6a3ce929d0e0e4736", "4bf92f3577b34da6a3ce929d0e0e4736", ""},
+		{"hex with spaces", " 4bf92f3577b34da6a3ce929d0e0e4736\n", "4bf92f3577b34da6a3ce929d0e0e4736", ""},
+		{"short", "a3ce929d0e0e4736", "0000000000000000a3ce929d0e0e4736", ""},
+		{"stackdriver", "4bf92f3577b34da6a3ce929d0e0e4736/1;o=1", "4bf92f3577b34da6a3ce929d0e0e4736", ""},
+		{"stackdriver no options", "4bf92f3577b34da6a3ce929d0e0e4736/1", "4bf92f3577b34da6a3ce929d0e0e4736", ""},
+		{"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", ""},
+
+		{"empty", "", "", `invalid trace id "", expecting 32 or 16 hexadecimal characters`},
+		{"invalid length", "4bf92f", "", `invalid trace id "4bf92f", expecting 32 or 16 hexadecimal characters`},
+		{"invalid hex", "zbf92f3577b34da6a3ce929d0e0e4736", "", `invalid trace id "zbf92f3577b34da6a3ce929d0e0e4736", expecting 32 or 16 hexadecimal characters`},
+		{"invalid stackdriver trace", "4bf92f/1;o=1", "", `invalid StackDriver value "4bf92f/1;o=1", trace id should have 32 hexadecimal characters`},
+		{"invalid stackdriver span", "4bf92f3577b34da6a3ce929d0e0e4736/abc", "", `invalid StackDriver value "4bf92f3577b34da6a3ce929d0e0e4736/abc", span id should be a decimal unsigned integer: strconv.ParseUint: parsing "abc": invalid syntax`},
+		{"invalid traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-01", "", `invalid traceparent value "00-4bf92f3577b34da6a3ce929d0e0e4736-01"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			traceID, err := ParseTraceID(test.in)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, FormatTraceIDHex(traceID))
+		})
+	}
+}
+
+func TestParseSpanID(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          string
+		expected    string
+		expectedErr string
+	}{
+		{"hex", "00f067aa0ba902b7", "00f067aa0ba902b7", ""},
+		{"stackdriver", "4bf92f3577b34da6a3ce929d0e0e4736/67667974448284343;o=1", "00f067aa0ba902b7", ""},
+		{"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "00f067aa0ba902b7", ""},
+
+		{"empty", "", "", `invalid span id "", expecting 16 hexadecimal characters`},
+		{"trace id", "4bf92f3577b34da6a3ce929d0e0e4736", "", `invalid span id "4bf92f3577b34da6a3ce929d0e0e4736", expecting 16 hexadecimal characters`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spanID, err := ParseSpanID(test.in)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, spanID.String())
+		})
+	}
+}
+
+func TestFormatSpanContext(t *testing.T) {
+	sc := trace.SpanContext{
+		TraceID:      NewFixedTraceID("4bf92f3577b34da6a3ce929d0e0e4736"),
+		SpanID:       trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceOptions: 1,
+	}
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", FormatTraceIDHex(sc.TraceID))
+	assert.Equal(t, "a3ce929d0e0e4736", FormatTraceIDShort(sc.TraceID))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736/67667974448284343;o=1", FormatStackDriverHeader(sc))
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", FormatTraceparent(sc))
+
+	for _, formatted := range []string{FormatStackDriverHeader(sc), FormatTraceparent(sc)} {
+		traceID, err := ParseTraceID(formatted)
+		require.NoError(t, err)
+		assert.Equal(t, sc.TraceID, traceID)
+
+		spanID, err := ParseSpanID(formatted)
+		require.NoError(t, err)
+		assert.Equal(t, sc.SpanID, spanID)
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/uber/jaeger-client-go/thrift"
+	"github.com/uber/jaeger-client-go/thrift-gen/agent"
+	jaegerpb "github.com/uber/jaeger-client-go/thrift-gen/jaeger"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"google.golang.org/api/support/bundler"
+)
+
+// udpPacketMaxLength is the max size of an UDP packet we send to the Jaeger agent,
+// big enough to hold a decent batch but small enough to fit the agent default buffer.
+const udpPacketMaxLength = 65000
+
+// JaegerOption configures a Jaeger exporter, see the various `WithJaeger*` functions.
+type JaegerOption func(config *jaegerConfig)
+
+type jaegerConfig struct {
+	processTags        TraceAttributes
+	bufferedSpansLimit int
+	httpClient         *http.Client
+	username           string
+	password           string
+}
+
+// WithJaegerProcessTags adds tags to the process describing this service, by default
+// `serviceName` and `pod` tags are defined.
+func WithJaegerProcessTags(tags TraceAttributes) JaegerOption {
+	return func(config *jaegerConfig) {
+		for key, value := range tags {
+			config.processTags[key] = value
+		}
+	}
+}
+
+// WithJaegerBufferedSpansLimit sets the maximum number of spans waiting to be exported,
+// spans are dropped past this limit. Defaults to 8192 spans.
+func WithJaegerBufferedSpansLimit(limit int) JaegerOption {
+	return func(config *jaegerConfig) {
+		config.bufferedSpansLimit = limit
+	}
+}
+
+// WithJaegerHTTPClient sets the HTTP client used to send spans to the collector, only
+// used for collector endpoints.
+func WithJaegerHTTPClient(client *http.Client) JaegerOption {
+	return func(config *jaegerConfig) {
+		config.httpClient = client
+	}
+}
+
+// WithJaegerBasicAuth sets the credentials used to authenticate against the collector,
+// only used for collector endpoints.
+func WithJaegerBasicAuth(username, password string) JaegerOption {
+	return func(config *jaegerConfig) {
+		config.username = username
+		config.password = password
+	}
+}
+
+// RegisterJaegerExporter registers a Jaeger exporter that exports all traces to the
+// Jaeger instance pointed by `endpoint`. The endpoint format selects the transport:
+//
+//   - `http://host:14268[/path]` or `https://...` sends spans to the collector HTTP
+//     (Thrift) endpoint, the path defaults to `/api/traces` when empty
+//   - `udp://host:6831` or `host:6831` sends spans to the agent UDP (compact Thrift)
+//     endpoint
+//
+// The process of all exported spans is tagged with `serviceName` and `pod` like
+// `RegisterStackDriverExporter` does.
+//
+// The returned ShutdownFunc unregisters the exporter, sends all pending spans and closes
+// the connection to Jaeger.
+func RegisterJaegerExporter(serviceName string, endpoint string, options ...JaegerOption) (ShutdownFunc, error) {
+	exporter, err := NewJaegerExporter(serviceName, endpoint, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return registerExporter(exporter), nil
+}
+
+// JaegerExporter is a `trace.Exporter` that sends spans in batches to a Jaeger
+// collector or agent.
+type JaegerExporter struct {
+	process *jaegerpb.Process
+	client  jaegerClient
+	bundler *bundler.Bundler
+}
+
+// Compile time assertion that the exporter implements trace.Exporter
+var _ trace.Exporter = (*JaegerExporter)(nil)
+
+type jaegerClient interface {
+	emitBatch(batch *jaegerpb.Batch) error
+	close() error
+}
+
+// NewJaegerExporter creates a Jaeger exporter without registering it, see
+// `RegisterJaegerExporter` for the accepted `endpoint` format.
+func NewJaegerExporter(serviceName string, endpoint string, options ...JaegerOption) (*JaegerExporter, error) {
+	config := &jaegerConfig{
+		processTags:        TraceAttributes{"serviceName": serviceName, "pod": hostname},
+		bufferedSpansLimit: 8192,
+		httpClient:         http.DefaultClient,
+	}
+
+	for _, option := range options {
+		option(config)
+	}
+
+	var client jaegerClient
+	var err error
+	switch {
+	case strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://"):
+		client, err = newJaegerCollectorClient(endpoint, config)
+	default:
+		client, err = newJaegerAgentClient(strings.TrimPrefix(endpoint, "udp://"), udpPacketMaxLength)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid jaeger exporter endpoint %q: %s", endpoint, err)
+	}
+
+	exporter := &JaegerExporter{
+		process: &jaegerpb.Process{ServiceName: serviceName, Tags: toJaegerTags(config.processTags)},
+		client:  client,
+	}
+
+	exporter.bundler = bundler.NewBundler((*jaegerpb.Span)(nil), func(bundle interface{}) {
+		exporter.emitSpans(bundle.([]*jaegerpb.Span))
+	})
+	// The bundler works with sizes, each span accounts for a size of 1
+	exporter.bundler.BufferedByteLimit = config.bufferedSpansLimit
+
+	return exporter, nil
+}
+
+// ExportSpan queues the span for export, it's dropped if too many spans are
+// already waiting to be exported.
+func (e *JaegerExporter) ExportSpan(span *trace.SpanData) {
+	if err := e.bundler.Add(toJaegerSpan(span), 1); err != nil {
+		zlog.Debug("dropping span, jaeger exporter buffer is full", zap.String("name", span.Name), zap.Error(err))
+	}
+}
+
+// Flush waits for all queued spans to be exported.
+func (e *JaegerExporter) Flush() {
+	e.bundler.Flush()
+}
+
+// Close flushes all queued spans and closes the connection to Jaeger.
+func (e *JaegerExporter) Close() error {
+	e.bundler.Flush()
+	return e.client.close()
+}
+
+func (e *JaegerExporter) emitSpans(spans []*jaegerpb.Span) {
+	err := e.client.emitBatch(&jaegerpb.Batch{Process: e.process, Spans: spans})
+	if err == errJaegerBatchTooLarge && len(spans) > 1 {
+		e.emitSpans(spans[:len(spans)/2])
+		e.emitSpans(spans[len(spans)/2:])
+		return
+	}
+
+	if err != nil {
+		zlog.Info("failed to export spans to jaeger", zap.Int("span_count", len(spans)), zap.Error(err))
+	}
+}
+
+var errJaegerBatchTooLarge = fmt.Errorf("batch too large for a single udp packet")
+
+type jaegerAgentClient struct {
+	conn          *net.UDPConn
+	client        *agent.AgentClient
+	buffer        *thrift.TMemoryBuffer
+	maxPacketSize int
+}
+
+func newJaegerAgentClient(hostPort string, maxPacketSize int) (*jaegerAgentClient, error) {
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		return nil, err
+	}
+
+	address, err := net.ResolveUDPAddr("udp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP(address.Network(), nil, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetWriteBuffer(maxPacketSize); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	buffer := thrift.NewTMemoryBufferLen(maxPacketSize)
+
+	return &jaegerAgentClient{
+		conn:          conn,
+		client:        agent.NewAgentClientFactory(buffer, thrift.NewTCompactProtocolFactory()),
+		buffer:        buffer,
+		maxPacketSize: maxPacketSize,
+	}, nil
+}
+
+func (c *jaegerAgentClient) emitBatch(batch *jaegerpb.Batch) error {
+	c.buffer.Reset()
+	// One-way UDP messages have no need for distinct sequence ids
+	c.client.SeqId = 0
+	if err := c.client.EmitBatch(batch); err != nil {
+		return err
+	}
+
+	if c.buffer.Len() > c.maxPacketSize {
+		return errJaegerBatchTooLarge
+	}
+
+	_, err := c.conn.Write(c.buffer.Bytes())
+	return err
+}
+
+func (c *jaegerAgentClient) close() error {
+	return c.conn.Close()
+}
+
+type jaegerCollectorClient struct {
+	url        string
+	username   string
+	password   string
+	httpClient *http.Client
+}
+
+func newJaegerCollectorClient(endpoint string, config *jaegerConfig) (*jaegerCollectorClient, error) {
+	collectorURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if collectorURL.Path == "" || collectorURL.Path == "/" {
+		collectorURL.Path = "/api/traces"
+	}
+
+	return &jaegerCollectorClient{
+		url:        collectorURL.String(),
+		username:   config.username,
+		password:   config.password,
+		httpClient: config.httpClient,
+	}, nil
+}
+
+func (c *jaegerCollectorClient) emitBatch(batch *jaegerpb.Batch) error {
+	buffer := thrift.NewTMemoryBuffer()
+	if err := batch.Write(thrift.NewTBinaryProtocolTransport(buffer)); err != nil {
+		return fmt.Errorf("unable to serialize batch: %s", err)
+	}
+
+	request, err := http.NewRequest("POST", c.url, bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/x-thrift")
+	if c.username != "" || c.password != "" {
+		request.SetBasicAuth(c.username, c.password)
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("jaeger collector responded with status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *jaegerCollectorClient) close() error {
+	return nil
+}
+
+func toJaegerSpan(span *trace.SpanData) *jaegerpb.Span {
+	tags := toJaegerTags(span.Attributes)
+	switch span.SpanKind {
+	case trace.SpanKindServer:
+		tags = append(tags, toJaegerTag("span.kind", "server"))
+	case trace.SpanKindClient:
+		tags = append(tags, toJaegerTag("span.kind", "client"))
+	}
+
+	if span.Code != 0 {
+		tags = append(tags,
+			toJaegerTag("error", true),
+			toJaegerTag("status.code", int64(span.Code)),
+			toJaegerTag("status.message", span.Message),
+		)
+	}
+
+	var logs []*jaegerpb.Log
+	for _, annotation := range span.Annotations {
+		fields := toJaegerTags(annotation.Attributes)
+		fields = append(fields, toJaegerTag("message", annotation.Message))
+		logs = append(logs, &jaegerpb.Log{Timestamp: annotation.Time.UnixNano() / 1000, Fields: fields})
+	}
+
+	var references []*jaegerpb.SpanRef
+	for _, link := range span.Links {
+		traceID, spanID := link.TraceID, link.SpanID
+		references = append(references, &jaegerpb.SpanRef{
+			RefType:     jaegerpb.SpanRefType_FOLLOWS_FROM,
+			TraceIdHigh: bytesToInt64(traceID[0:8]),
+			TraceIdLow:  bytesToInt64(traceID[8:16]),
+			SpanId:      bytesToInt64(spanID[:]),
+		})
+	}
+
+	return &jaegerpb.Span{
+		TraceIdHigh:   bytesToInt64(span.TraceID[0:8]),
+		TraceIdLow:    bytesToInt64(span.TraceID[8:16]),
+		SpanId:        bytesToInt64(span.SpanID[:]),
+		ParentSpanId:  bytesToInt64(span.ParentSpanID[:]),
+		OperationName: span.Name,
+		Flags:         int32(span.TraceOptions),
+		StartTime:     span.StartTime.UnixNano() / 1000,
+		Duration:      span.EndTime.Sub(span.StartTime).Nanoseconds() / 1000,
+		Tags:          tags,
+		Logs:          logs,
+		References:    references,
+	}
+}
+
+func toJaegerTags(attributes map[string]interface{}) []*jaegerpb.Tag {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	tags := make([]*jaegerpb.Tag, 0, len(attributes))
+	for key, value := range attributes {
+		tags = append(tags, toJaegerTag(key, value))
+	}
+
+	return tags
+}
+
+func toJaegerTag(key string, value interface{}) *jaegerpb.Tag {
+	switch v := value.(type) {
+	case string:
+		return &jaegerpb.Tag{Key: key, VType: jaegerpb.TagType_STRING, VStr: &v}
+	case bool:
+		return &jaegerpb.Tag{Key: key, VType: jaegerpb.TagType_BOOL, VBool: &v}
+	case int64:
+		return &jaegerpb.Tag{Key: key, VType: jaegerpb.TagType_LONG, VLong: &v}
+	case float64:
+		return &jaegerpb.Tag{Key: key, VType: jaegerpb.TagType_DOUBLE, VDouble: &v}
+	default:
+		str := fmt.Sprintf("%v", v)
+		return &jaegerpb.Tag{Key: key, VType: jaegerpb.TagType_STRING, VStr: &str}
+	}
+}
+
+func bytesToInt64(buffer []byte) int64 {
+	return int64(binary.BigEndian.Uint64(buffer))
+}
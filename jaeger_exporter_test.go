@@ -0,0 +1,102 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/jaeger-client-go/thrift"
+	jaegerpb "github.com/uber/jaeger-client-go/thrift-gen/jaeger"
+	"go.opencensus.io/trace"
+)
+
+func TestJaegerExporter_Collector(t *testing.T) {
+	batches := make(chan *jaegerpb.Batch, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/traces", r.URL.Path)
+		assert.Equal(t, "application/x-thrift", r.Header.Get("Content-Type"))
+
+		payload, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		buffer := thrift.NewTMemoryBuffer()
+		buffer.Write(payload)
+
+		batch := &jaegerpb.Batch{}
+		require.NoError(t, batch.Read(thrift.NewTBinaryProtocolTransport(buffer)))
+		batches <- batch
+	}))
+	defer server.Close()
+
+	exporter, err := NewJaegerExporter("test", server.URL)
+	require.NoError(t, err)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	exporter.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID: NewFixedTraceID("000000000000000a000000000000000b"),
+			SpanID:  trace.SpanID{0, 0, 0, 0, 0, 0, 0, 12},
+		},
+		Name:       "operation",
+		SpanKind:   trace.SpanKindClient,
+		StartTime:  start,
+		EndTime:    start.Add(time.Millisecond),
+		Attributes: map[string]interface{}{"key": "value"},
+	})
+	require.NoError(t, exporter.Close())
+
+	batch := <-batches
+	assert.Equal(t, "test", batch.Process.ServiceName)
+	assert.Equal(t, "test", jaegerTagsToMap(batch.Process.Tags)["serviceName"])
+	assert.Contains(t, jaegerTagsToMap(batch.Process.Tags), "pod")
+
+	require.Len(t, batch.Spans, 1)
+	span := batch.Spans[0]
+	assert.Equal(t, "operation", span.OperationName)
+	assert.Equal(t, int64(10), span.TraceIdHigh)
+	assert.Equal(t, int64(11), span.TraceIdLow)
+	assert.Equal(t, int64(12), span.SpanId)
+	assert.Equal(t, int64(1000), span.Duration)
+	assert.Equal(t, map[string]interface{}{"key": "value", "span.kind": "client"}, jaegerTagsToMap(span.Tags))
+}
+
+func TestNewJaegerExporter_InvalidAgentEndpoint(t *testing.T) {
+	_, err := NewJaegerExporter("test", "localhost")
+	assert.EqualError(t, err, `invalid jaeger exporter endpoint "localhost": address localhost: missing port in address`)
+}
+
+func jaegerTagsToMap(tags []*jaegerpb.Tag) map[string]interface{} {
+	out := map[string]interface{}{}
+	for _, tag := range tags {
+		switch tag.VType {
+		case jaegerpb.TagType_STRING:
+			out[tag.Key] = *tag.VStr
+		case jaegerpb.TagType_BOOL:
+			out[tag.Key] = *tag.VBool
+		case jaegerpb.TagType_LONG:
+			out[tag.Key] = *tag.VLong
+		case jaegerpb.TagType_DOUBLE:
+			out[tag.Key] = *tag.VDouble
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/status"
+)
+
+// Trace starts a span (see `StartSpan`), calls `fn` with the span's context and ends
+// the span with the error returned by `fn` (see `EndSpan`), returning it unchanged.
+//
+//	err := dtracing.Trace(ctx, "fetch_block", func(ctx context.Context) error {
+//		return fetchBlock(ctx, num)
+//	}, "block_num", num)
+func Trace(ctx context.Context, name string, fn func(ctx context.Context) error, keyedAttributes ...interface{}) (err error) {
+	ctx, span := StartSpan(ctx, name, keyedAttributes...)
+	defer EndSpan(span, &err)
+
+	return fn(ctx)
+}
+
+// TraceA is exactly like `Trace` but accepts `trace.Attribute` directly, see `StartSpanA`.
+func TraceA(ctx context.Context, name string, fn func(ctx context.Context) error, attributes ...trace.Attribute) (err error) {
+	ctx, span := StartSpanA(ctx, name, attributes...)
+	defer EndSpan(span, &err)
+
+	return fn(ctx)
+}
+
+// EndSpan ends the span, setting its status from the error pointed to by `err` (see
+// `StatusFromError`) and recording the error message as an annotation. It must be
+// deferred directly, so that panics are recovered, recorded on the span along with
+// their stack trace, and re-raised once the span has ended:
+//
+//	func fetch(ctx context.Context) (err error) {
+//		ctx, span := dtracing.StartSpan(ctx, "fetch")
+//		defer dtracing.EndSpan(span, &err)
+//		...
+//	}
+func EndSpan(span *trace.Span, err *error) {
+	if r := recover(); r != nil {
+		span.Annotate([]trace.Attribute{
+			trace.StringAttribute("panic", fmt.Sprintf("%v", r)),
+			trace.StringAttribute("stack", string(debug.Stack())),
+		}, "panic")
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: fmt.Sprintf("panic: %v", r)})
+		span.End()
+
+		panic(r)
+	}
+
+	if err != nil && *err != nil {
+		span.Annotate([]trace.Attribute{trace.StringAttribute("error", (*err).Error())}, "error")
+		span.SetStatus(StatusFromError(*err))
+	}
+
+	span.End()
+}
+
+// StatusFromError maps an error to a `trace.Status`, nil being `OK`, `context.Canceled`
+// being `CANCELLED`, `context.DeadlineExceeded` being `DEADLINE_EXCEEDED`, gRPC status
+// errors being their gRPC code (gRPC codes being the same as OpenCensus status codes)
+// and anything else `UNKNOWN`. Wrapped errors are recognized.
+func StatusFromError(err error) trace.Status {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+
+	switch {
+	case err == nil:
+		return trace.Status{Code: trace.StatusCodeOK}
+	case errors.Is(err, context.Canceled):
+		return trace.Status{Code: trace.StatusCodeCancelled, Message: err.Error()}
+	case errors.Is(err, context.DeadlineExceeded):
+		return trace.Status{Code: trace.StatusCodeDeadlineExceeded, Message: err.Error()}
+	case errors.As(err, &grpcErr):
+		grpcStatus := grpcErr.GRPCStatus()
+		return trace.Status{Code: int32(grpcStatus.Code()), Message: grpcStatus.Message()}
+	default:
+		return trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatusFromError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected trace.Status
+	}{
+		{"nil", nil, trace.Status{Code: trace.StatusCodeOK}},
+		{"canceled", context.Canceled, trace.Status{Code: trace.StatusCodeCancelled, Message: "context canceled"}},
+		{"wrapped deadline", fmt.Errorf("fetch: %w", context.DeadlineExceeded), trace.Status{Code: trace.StatusCodeDeadlineExceeded, Message: "fetch: context deadline exceeded"}},
+		{"grpc", status.Error(codes.NotFound, "no block"), trace.Status{Code: trace.StatusCodeNotFound, Message: "no block"}},
+		{"other", errors.New("failed"), trace.Status{Code: trace.StatusCodeUnknown, Message: "failed"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, StatusFromError(test.err))
+		})
+	}
+}
+
+func TestTrace(t *testing.T) {
+	exporter := &capturingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	ctx, parent := trace.StartSpan(context.Background(), "parent", trace.WithSampler(trace.AlwaysSample()))
+
+	err := Trace(ctx, "ok", func(ctx context.Context) error {
+		assert.NotEqual(t, parent, trace.FromContext(ctx))
+		return nil
+	}, "key", "value")
+	require.NoError(t, err)
+
+	err = TraceA(ctx, "failing", func(ctx context.Context) error {
+		return context.Canceled
+	})
+	assert.Equal(t, context.Canceled, err)
+
+	assert.PanicsWithValue(t, "boom", func() {
+		Trace(ctx, "panicking", func(ctx context.Context) error { panic("boom") })
+	})
+
+	require.Len(t, exporter.spans, 3)
+
+	okSpan := exporter.spans[0]
+	assert.Equal(t, parent.SpanContext().SpanID, okSpan.ParentSpanID)
+	assert.Equal(t, "value", okSpan.Attributes["key"])
+	assert.Equal(t, trace.Status{Code: trace.StatusCodeOK}, okSpan.Status)
+	assert.Empty(t, okSpan.Annotations)
+
+	failingSpan := exporter.spans[1]
+	assert.Equal(t, trace.Status{Code: trace.StatusCodeCancelled, Message: "context canceled"}, failingSpan.Status)
+	require.Len(t, failingSpan.Annotations, 1)
+	assert.Equal(t, "error", failingSpan.Annotations[0].Message)
+	assert.Equal(t, "context canceled", failingSpan.Annotations[0].Attributes["error"])
+
+	panickingSpan := exporter.spans[2]
+	assert.Equal(t, trace.Status{Code: trace.StatusCodeUnknown, Message: "panic: boom"}, panickingSpan.Status)
+	require.Len(t, panickingSpan.Annotations, 1)
+	assert.Equal(t, "panic", panickingSpan.Annotations[0].Message)
+	assert.Equal(t, "boom", panickingSpan.Annotations[0].Attributes["panic"])
+	assert.Contains(t, panickingSpan.Annotations[0].Attributes["stack"], "lifecycle_test.go")
+}
@@ -15,7 +15,238 @@
 package dtracing
 
 import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+
 	"github.com/streamingfast/logging"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
 )
 
 var zlog, _ = logging.PackageLogger("dtracing", "github.com/streamingfast/dtracing")
+
+type baseLoggerKeyType int
+
+// baseLoggerKey holds the logger, before its enrichment with span fields, of the
+// logger attached to the context, so that enriching it again for a child span does
+// not duplicate the fields.
+const baseLoggerKey baseLoggerKeyType = iota
+
+// enrichedLogger is the value stored under `baseLoggerKey`, `enriched` being the logger
+// attached to the context when `base` was stored.
+type enrichedLogger struct {
+	base     *zap.Logger
+	enriched *zap.Logger
+}
+
+// Logger returns the logger attached to the context (see `logging.Logger`) enriched
+// with the `trace_id`, `span_id` and `trace_sampled` fields of the span active in the
+// context. When there is no active span, the logger attached to the context is returned
+// as is, `fallbackLogger` being used when the context has no logger.
+func Logger(ctx context.Context, fallbackLogger *zap.Logger) *zap.Logger {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return logging.Logger(ctx, fallbackLogger)
+	}
+
+	return baseLogger(ctx, fallbackLogger).With(spanLoggerFields(span)...)
+}
+
+// baseLogger returns the logger to enrich with span fields. The stored base logger is
+// only reused while the logger attached to the context is still the one enriched from
+// it, a logger attached afterwards (e.g. `logging.WithLogger(ctx, logger.With(...))`)
+// being enriched as is so that its fields are kept.
+func baseLogger(ctx context.Context, fallbackLogger *zap.Logger) *zap.Logger {
+	logger := logging.Logger(ctx, fallbackLogger)
+	if stored, ok := ctx.Value(baseLoggerKey).(enrichedLogger); ok && stored.enriched == logger {
+		return stored.base
+	}
+
+	return logger
+}
+
+// withBaseLogger attaches `enriched` to the context, remembering `base` as the logger
+// it was enriched from.
+func withBaseLogger(ctx context.Context, base *zap.Logger, enriched *zap.Logger) context.Context {
+	ctx = context.WithValue(ctx, baseLoggerKey, enrichedLogger{base, enriched})
+	return logging.WithLogger(ctx, enriched)
+}
+
+// withEnrichedLogger attaches to the context `base` enriched with the fields of the
+// span, retrievable through `logging.Logger` or `Logger`.
+func withEnrichedLogger(ctx context.Context, base *zap.Logger, span *trace.Span) context.Context {
+	return withBaseLogger(ctx, base, base.With(spanLoggerFields(span)...))
+}
+
+// spanLoggerFields returns the fields identifying the span, along with a hidden field
+// holding the span itself, used by `NewSpanAnnotatingCore`.
+func spanLoggerFields(span *trace.Span) []zap.Field {
+	spanContext := span.SpanContext()
+	fields := []zap.Field{
+		spanField(span),
+		zap.Stringer("trace_id", traceID(spanContext.TraceID)),
+		zap.Stringer("span_id", spanContext.SpanID),
+		zap.Bool("trace_sampled", spanContext.IsSampled()),
+	}
+
+	if projectID, ok := stackDriverLogFieldsProjectID(); ok {
+		fields = append(fields,
+			zap.String(stackDriverTraceLogField, stackDriverTraceName(projectID, spanContext.TraceID)),
+			zap.Stringer(stackDriverSpanIDLogField, spanContext.SpanID),
+			zap.Bool(stackDriverTraceSampledLogField, spanContext.IsSampled()),
+		)
+	}
+
+	return fields
+}
+
+// traceIDLoggerFields returns the fields identifying a trace when no span is known.
+func traceIDLoggerFields(id trace.TraceID) []zap.Field {
+	fields := []zap.Field{zap.Stringer("trace_id", traceID(id))}
+	if projectID, ok := stackDriverLogFieldsProjectID(); ok {
+		fields = append(fields, zap.String(stackDriverTraceLogField, stackDriverTraceName(projectID, id)))
+	}
+
+	return fields
+}
+
+const (
+	stackDriverTraceLogField        = "logging.googleapis.com/trace"
+	stackDriverSpanIDLogField       = "logging.googleapis.com/spanId"
+	stackDriverTraceSampledLogField = "logging.googleapis.com/trace_sampled"
+)
+
+// LogFieldsFormat controls the fields added to loggers to correlate logs with traces.
+type LogFieldsFormat int32
+
+const (
+	// LogFieldsFormatAuto uses `LogFieldsFormatStackDriver` when in production (see
+	// `IsProductionEnvironment`) and `LogFieldsFormatDefault` otherwise.
+	LogFieldsFormatAuto LogFieldsFormat = iota
+
+	// LogFieldsFormatDefault adds the `trace_id`, `span_id` and `trace_sampled` fields.
+	LogFieldsFormatDefault
+
+	// LogFieldsFormatStackDriver adds, on top of the default fields, the fields Cloud
+	// Logging uses to link a log line to its trace, `logging.googleapis.com/trace` (as
+	// `projects/<project>/traces/<trace_id>`), `logging.googleapis.com/spanId` and
+	// `logging.googleapis.com/trace_sampled`. The project ID is the one of the
+	// `stackdriver.Options` given to `RegisterStackDriverExporter`, the one set through
+	// `SetLogFieldsProjectID` or else the first of the `GOOGLE_CLOUD_PROJECT`, `GCP_PROJECT`
+	// and `GCLOUD_PROJECT` environment variables defined. When no project ID can be
+	// resolved, only the default fields are added.
+	LogFieldsFormatStackDriver
+)
+
+var logFieldsFormat int32 // access atomically
+var logFieldsProjectID atomic.Value
+
+var autoLogFieldsFormatOnce sync.Once
+var autoLogFieldsFormat LogFieldsFormat
+
+// SetLogFieldsFormat sets the format of the fields added to loggers by `Logger`,
+// `EnrichLogger`, the middlewares and the gRPC interceptors, `LogFieldsFormatAuto`
+// being the default.
+func SetLogFieldsFormat(format LogFieldsFormat) {
+	atomic.StoreInt32(&logFieldsFormat, int32(format))
+}
+
+// SetLogFieldsProjectID sets the GCP project ID used by `LogFieldsFormatStackDriver`.
+func SetLogFieldsProjectID(projectID string) {
+	logFieldsProjectID.Store(projectID)
+}
+
+func getLogFieldsFormat() LogFieldsFormat {
+	format := LogFieldsFormat(atomic.LoadInt32(&logFieldsFormat))
+	if format != LogFieldsFormatAuto {
+		return format
+	}
+
+	autoLogFieldsFormatOnce.Do(func() {
+		autoLogFieldsFormat = LogFieldsFormatDefault
+		if IsProductionEnvironment() {
+			autoLogFieldsFormat = LogFieldsFormatStackDriver
+		}
+	})
+
+	return autoLogFieldsFormat
+}
+
+// stackDriverLogFieldsProjectID returns the project ID to use in StackDriver log fields,
+// false if StackDriver log fields should not be added.
+func stackDriverLogFieldsProjectID() (string, bool) {
+	if getLogFieldsFormat() != LogFieldsFormatStackDriver {
+		return "", false
+	}
+
+	if projectID, _ := logFieldsProjectID.Load().(string); projectID != "" {
+		return projectID, true
+	}
+
+	for _, name := range []string{"GOOGLE_CLOUD_PROJECT", "GCP_PROJECT", "GCLOUD_PROJECT"} {
+		if projectID := os.Getenv(name); projectID != "" {
+			return projectID, true
+		}
+	}
+
+	return "", false
+}
+
+func stackDriverTraceName(projectID string, id trace.TraceID) string {
+	return "projects/" + projectID + "/traces/" + traceID(id).String()
+}
+
+// SpanOption can be passed among the keyed attributes of `StartSpan` (and friends)
+// to configure the started span, it can appear anywhere in the keyed attributes.
+type SpanOption interface {
+	applyToSpan(ctx context.Context, span *trace.Span) context.Context
+}
+
+type spanOptionFunc func(ctx context.Context, span *trace.Span) context.Context
+
+func (f spanOptionFunc) applyToSpan(ctx context.Context, span *trace.Span) context.Context {
+	return f(ctx, span)
+}
+
+// EnrichLogger attaches to the context returned by `StartSpan` (and friends) the
+// logger of the context enriched with the fields of the started span (see `Logger`),
+// so that `logging.Logger(ctx, ...)` in nested operations logs the right span.
+func EnrichLogger() SpanOption {
+	return spanOptionFunc(func(ctx context.Context, span *trace.Span) context.Context {
+		return withEnrichedLogger(ctx, baseLogger(ctx, zlog), span)
+	})
+}
+
+func extractSpanOptions(keyedAttributes []interface{}) (attributes []interface{}, options []SpanOption) {
+	for _, keyedAttribute := range keyedAttributes {
+		if _, ok := keyedAttribute.(SpanOption); ok {
+			// Only allocate when there is at least one option, which is the uncommon case
+			attributes = make([]interface{}, 0, len(keyedAttributes))
+			break
+		}
+	}
+
+	if attributes == nil {
+		return keyedAttributes, nil
+	}
+
+	for _, keyedAttribute := range keyedAttributes {
+		if option, ok := keyedAttribute.(SpanOption); ok {
+			options = append(options, option)
+		} else {
+			attributes = append(attributes, keyedAttribute)
+		}
+	}
+
+	return attributes, options
+}
+
+func applySpanOptions(ctx context.Context, span *trace.Span, options []SpanOption) context.Context {
+	for _, option := range options {
+		ctx = option.applyToSpan(ctx, span)
+	}
+
+	return ctx
+}
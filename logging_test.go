@@ -0,0 +1,121 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/streamingfast/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogger(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	ctx := logging.WithLogger(context.Background(), zap.New(core))
+
+	Logger(ctx, zlog).Info("no span")
+
+	parentCtx, parent := StartSpanWithSampler(ctx, "parent", trace.AlwaysSample(), "key", "value", EnrichLogger())
+	Logger(parentCtx, zlog).Info("parent")
+
+	childCtx, child := StartSpan(parentCtx, "child", EnrichLogger())
+	logging.Logger(childCtx, zlog).Info("child")
+	Logger(childCtx, zlog).Info("child through dtracing")
+
+	_, grandChild := StartSpan(childCtx, "grand_child")
+	Logger(trace.NewContext(childCtx, grandChild), zlog).Info("grand child")
+
+	entries := logs.TakeAll()
+	require.Len(t, entries, 5)
+
+	assert.Empty(t, entries[0].Context)
+
+	expectFields := func(entry observer.LoggedEntry, span *trace.Span) {
+		t.Helper()
+
+		spanContext := span.SpanContext()
+		assert.Equal(t, map[string]interface{}{
+			"trace_id":      spanContext.TraceID.String(),
+			"span_id":       spanContext.SpanID.String(),
+			"trace_sampled": true,
+		}, entry.ContextMap(), entry.Message)
+	}
+
+	expectFields(entries[1], parent)
+	expectFields(entries[2], child)
+	expectFields(entries[3], child)
+	expectFields(entries[4], grandChild)
+}
+
+func TestLogger_KeepsFieldsAddedAfterEnrichment(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	ctx := logging.WithLogger(context.Background(), zap.New(core))
+
+	parentCtx, parent := StartSpanWithSampler(ctx, "parent", trace.AlwaysSample(), EnrichLogger())
+	defer parent.End()
+
+	parentCtx = logging.WithLogger(parentCtx, logging.Logger(parentCtx, zlog).With(zap.String("request", "1")))
+
+	childCtx, child := StartSpan(parentCtx, "child", EnrichLogger())
+	defer child.End()
+
+	logging.Logger(childCtx, zlog).Info("child")
+	Logger(childCtx, zlog).Info("child through dtracing")
+
+	entries := logs.TakeAll()
+	require.Len(t, entries, 2)
+
+	for _, entry := range entries {
+		assert.Equal(t, "1", entry.ContextMap()["request"], entry.Message)
+		assert.Equal(t, child.SpanContext().SpanID.String(), entry.ContextMap()["span_id"], entry.Message)
+	}
+}
+
+func TestLogger_StackDriverFormat(t *testing.T) {
+	defer SetLogFieldsFormat(LogFieldsFormatAuto)
+	defer SetLogFieldsProjectID("")
+
+	SetLogFieldsFormat(LogFieldsFormatStackDriver)
+	SetLogFieldsProjectID("my-project")
+
+	core, logs := observer.New(zap.InfoLevel)
+	ctx := logging.WithLogger(context.Background(), zap.New(core))
+
+	ctx, span := StartSpanWithSampler(ctx, "span", trace.NeverSample())
+	Logger(ctx, zlog).Info("span")
+
+	spanContext := span.SpanContext()
+	assert.Equal(t, map[string]interface{}{
+		"trace_id":                             spanContext.TraceID.String(),
+		"span_id":                              spanContext.SpanID.String(),
+		"trace_sampled":                        false,
+		"logging.googleapis.com/trace":         "projects/my-project/traces/" + spanContext.TraceID.String(),
+		"logging.googleapis.com/spanId":        spanContext.SpanID.String(),
+		"logging.googleapis.com/trace_sampled": false,
+	}, logs.TakeAll()[0].ContextMap())
+
+	SetLogFieldsProjectID("")
+	os.Setenv("GCP_PROJECT", "env-project")
+	defer os.Unsetenv("GCP_PROJECT")
+
+	Logger(ctx, zlog).Info("span")
+	assert.Equal(t, "projects/env-project/traces/"+spanContext.TraceID.String(), logs.TakeAll()[0].ContextMap()["logging.googleapis.com/trace"])
+}
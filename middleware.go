@@ -15,34 +15,38 @@
 package dtracing
 
 import (
-	crand "crypto/rand"
-	"encoding/binary"
+	"bufio"
 	"encoding/hex"
-	"math/rand"
+	"fmt"
+	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
 
-	strackdriverPropagation "contrib.go.opencensus.io/exporter/stackdriver/propagation"
-	"github.com/streamingfast/logging"
+	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/trace"
 	"go.opencensus.io/trace/propagation"
 	"go.uber.org/zap"
 )
 
-var defaultFormat propagation.HTTPFormat = &strackdriverPropagation.HTTPFormat{}
-var traceIDGenerator *defaultIDGenerator
+const (
+	routeAttribute        = "http.route"
+	responseSizeAttribute = "http.response_size"
+	latencyAttribute      = "http.latency_ms"
+)
+
+var defaultFormat atomic.Value
 
 func init() {
-	traceIDGenerator = &defaultIDGenerator{}
-	// initialize traceID and spanID generators.
-	var rngSeed int64
-	for _, p := range []interface{}{
-		&rngSeed, &traceIDGenerator.traceIDAdd, &traceIDGenerator.nextSpanID, &traceIDGenerator.spanIDInc,
-	} {
-		binary.Read(crand.Reader, binary.LittleEndian, p)
-	}
+	setDefaultFormat(NewDefaultCompositeFormat())
+}
 
-	traceIDGenerator.traceIDRand = rand.New(rand.NewSource(rngSeed))
-	traceIDGenerator.spanIDInc |= 1
+func setDefaultFormat(format propagation.HTTPFormat) {
+	defaultFormat.Store(&format)
+}
+
+func getDefaultFormat() propagation.HTTPFormat {
+	return *defaultFormat.Load().(*propagation.HTTPFormat)
 }
 
 // NewAddTraceIDAwareLoggerMiddleware returns a http.Handler wrapper so that all requests of
@@ -52,7 +56,8 @@ func init() {
 //
 // This handler is aware of the incoming request's trace id, reading it from request headers as configured
 // using the Propagation field. The extracted trace id if present is used to configure the actual logger
-// with the field `trace_id`.
+// with the field `trace_id`. When `propagation` is nil, the default format is used which understands
+// W3C Trace Context, B3 and StackDriver headers (see `NewDefaultCompositeFormat`).
 //
 // If the trace id cannot be extracted from the request, a random request id is
 // generated and used under the field `trace_id`.
@@ -68,19 +73,80 @@ func NewAddTraceIDAwareLoggerMiddleware(next http.Handler, rootLogger *zap.Logge
 	}
 }
 
+// NewTracingMiddleware returns a http.Handler wrapper that starts a server span for every
+// request, using the span context extracted from the request headers (through `propagation`,
+// or the default format if nil) as the remote parent.
+//
+// The span records the method, route, status code, response size and latency of the request
+// and its status is derived from the HTTP status code. Like `NewAddTraceIDAwareLoggerMiddleware`,
+// a `zap.Logger` is attached to the request's context, instrumented with the `trace_id`,
+// `span_id` and `trace_sampled` fields of the started span (see `Logger`).
+func NewTracingMiddleware(next http.Handler, rootLogger *zap.Logger, propagation propagation.HTTPFormat, options ...MiddlewareOption) *addTraceIDMiddleware {
+	middleware := NewAddTraceIDAwareLoggerMiddleware(next, rootLogger, propagation)
+	middleware.startSpan = true
+	middleware.routeFunc = func(r *http.Request) string { return r.URL.Path }
+
+	for _, option := range options {
+		option(middleware)
+	}
+
+	return middleware
+}
+
+// MiddlewareOption configures the middleware returned by `NewTracingMiddleware`.
+type MiddlewareOption func(middleware *addTraceIDMiddleware)
+
+// WithMiddlewareRouteFunc sets the function resolving the route of a request, used as the
+// span name and the `http.route` attribute. Defaults to the request's URL path, prefer
+// returning the route template (`/users/{id}`) to keep span names cardinality low.
+func WithMiddlewareRouteFunc(routeFunc func(r *http.Request) string) MiddlewareOption {
+	return func(middleware *addTraceIDMiddleware) {
+		middleware.routeFunc = routeFunc
+	}
+}
+
+// WithMiddlewareSampler sets the sampler used for the server spans, the default sampler is
+// used otherwise.
+func WithMiddlewareSampler(sampler trace.Sampler) MiddlewareOption {
+	return func(middleware *addTraceIDMiddleware) {
+		middleware.sampler = sampler
+	}
+}
+
+// WithMiddlewarePublicEndpoint marks the handler as publicly accessible, the span context
+// extracted from the request is then linked to the server span instead of being its parent,
+// so that untrusted callers cannot control our traces.
+func WithMiddlewarePublicEndpoint() MiddlewareOption {
+	return func(middleware *addTraceIDMiddleware) {
+		middleware.publicEndpoint = true
+	}
+}
+
 type addTraceIDMiddleware struct {
 	// Handler is the handler used to handle the incoming request.
 	next http.Handler
 
 	// Propagation defines how traces are propagated. If unspecified,
-	// Stackdriver propagation will be used.
+	// the default format is used, a composite of W3C Trace Context, B3 and
+	// Stackdriver propagation unless configured otherwise through `WithPropagation`.
 	propagation propagation.HTTPFormat
 
 	// Actual root logger to instrument with request information
 	rootLogger *zap.Logger
+
+	// Tracing mode fields, only used when `startSpan` is true
+	startSpan      bool
+	routeFunc      func(r *http.Request) string
+	sampler        trace.Sampler
+	publicEndpoint bool
 }
 
 func (h *addTraceIDMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.startSpan {
+		h.serveWithSpan(w, r)
+		return
+	}
+
 	rootLogger := *h.rootLogger
 	spanContext, ok := extractSpanContext(r, h.propagation)
 
@@ -89,25 +155,103 @@ func (h *addTraceIDMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		// Not found in the header, check from the context directly than
 		span := trace.FromContext(r.Context())
 		if span == nil {
-			traceIDField := zap.Stringer("trace_id", traceID(traceIDGenerator.NewTraceID()))
-			logger = rootLogger.With(traceIDField)
+			logger = rootLogger.With(traceIDLoggerFields(getIDGenerator().NewTraceID())...)
 		} else {
-			spanContext := span.SpanContext()
-			traceID := hex.EncodeToString(spanContext.TraceID[:])
-			logger = rootLogger.With(zap.String("trace_id", traceID))
+			logger = rootLogger.With(traceIDLoggerFields(span.SpanContext().TraceID)...)
 		}
 	} else {
-		traceID := hex.EncodeToString(spanContext.TraceID[:])
-		logger = rootLogger.With(zap.String("trace_id", traceID))
+		logger = rootLogger.With(traceIDLoggerFields(spanContext.TraceID)...)
+	}
+
+	h.next.ServeHTTP(w, r.WithContext(withBaseLogger(r.Context(), h.rootLogger, logger)))
+}
+
+func (h *addTraceIDMiddleware) serveWithSpan(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	route := h.routeFunc(r)
+
+	startOptions := []trace.StartOption{trace.WithSpanKind(trace.SpanKindServer)}
+	if h.sampler != nil {
+		startOptions = append(startOptions, trace.WithSampler(h.sampler))
+	}
+
+	var span *trace.Span
+	ctx := r.Context()
+	remoteSpanContext, hasRemote := extractSpanContext(r, h.propagation)
+	if hasRemote && !h.publicEndpoint {
+		ctx, span = trace.StartSpanWithRemoteParent(ctx, route, remoteSpanContext, startOptions...)
+	} else {
+		ctx, span = trace.StartSpan(ctx, route, startOptions...)
+		if hasRemote {
+			span.AddLink(trace.Link{TraceID: remoteSpanContext.TraceID, SpanID: remoteSpanContext.SpanID, Type: trace.LinkTypeParent})
+		}
+	}
+	defer span.End()
+
+	span.AddAttributes(
+		trace.StringAttribute(ochttp.MethodAttribute, r.Method),
+		trace.StringAttribute(routeAttribute, route),
+		trace.StringAttribute(ochttp.PathAttribute, r.URL.Path),
+		trace.StringAttribute(ochttp.HostAttribute, r.Host),
+		trace.StringAttribute(ochttp.UserAgentAttribute, r.UserAgent()),
+	)
+
+	recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	h.next.ServeHTTP(recorder, r.WithContext(withEnrichedLogger(ctx, h.rootLogger, span)))
+
+	span.AddAttributes(
+		trace.Int64Attribute(ochttp.StatusCodeAttribute, int64(recorder.statusCode)),
+		trace.Int64Attribute(responseSizeAttribute, recorder.written),
+		trace.Int64Attribute(latencyAttribute, time.Since(start).Milliseconds()),
+	)
+	span.SetStatus(ochttp.TraceStatus(recorder.statusCode, http.StatusText(recorder.statusCode)))
+}
+
+// responseRecorder records the status code and the size of the response written by
+// the wrapped handler.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	statusCode  int
+	written     int64
+	wroteHeader bool
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if !r.wroteHeader {
+		r.statusCode = statusCode
+		r.wroteHeader = true
+	}
+
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+
+	n, err := r.ResponseWriter.Write(data)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying response writer does not implement http.Hijacker")
 	}
 
-	ctx := logging.WithLogger(r.Context(), logger)
-	h.next.ServeHTTP(w, r.WithContext(ctx))
+	return hijacker.Hijack()
 }
 
 func extractSpanContext(r *http.Request, propagation propagation.HTTPFormat) (trace.SpanContext, bool) {
 	if propagation == nil {
-		return defaultFormat.SpanContextFromRequest(r)
+		return getDefaultFormat().SpanContextFromRequest(r)
 	}
 
 	return propagation.SpanContextFromRequest(r)
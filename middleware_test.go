@@ -0,0 +1,84 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/streamingfast/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type capturingExporter struct {
+	lock  sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *capturingExporter) ExportSpan(span *trace.SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.spans = append(e.spans, span)
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	exporter := &capturingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	core, logs := observer.New(zap.InfoLevel)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.Logger(r.Context(), zlog).Info("handling")
+
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	})
+
+	middleware := NewTracingMiddleware(handler, zap.New(core), nil,
+		WithMiddlewareSampler(trace.AlwaysSample()),
+		WithMiddlewareRouteFunc(func(r *http.Request) string { return "/users/{id}" }),
+	)
+
+	req := httptest.NewRequest("GET", "/users/1", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.Len(t, exporter.spans, 1)
+	span := exporter.spans[0]
+
+	assert.Equal(t, "/users/{id}", span.Name)
+	assert.Equal(t, trace.SpanKindServer, span.SpanKind)
+	assert.Equal(t, NewFixedTraceID("0af7651916cd43dd8448eb211c80319c"), span.TraceID)
+	assert.Equal(t, trace.SpanID{0xb7, 0xad, 0x6b, 0x71, 0x69, 0x20, 0x33, 0x31}, span.ParentSpanID)
+	assert.True(t, span.HasRemoteParent)
+	assert.Equal(t, int32(trace.StatusCodeNotFound), span.Code)
+	assert.Equal(t, "GET", span.Attributes["http.method"])
+	assert.Equal(t, "/users/{id}", span.Attributes["http.route"])
+	assert.Equal(t, int64(404), span.Attributes["http.status_code"])
+	assert.Equal(t, int64(9), span.Attributes["http.response_size"])
+	assert.Contains(t, span.Attributes, "http.latency_ms")
+
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", fields["trace_id"])
+	assert.Equal(t, span.SpanID.String(), fields["span_id"])
+}
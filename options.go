@@ -0,0 +1,292 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+)
+
+// Option configures the behavior of `Setup` (and `SetupTracing`), see the
+// various `With*` functions for available options.
+type Option interface {
+	apply(config *setupConfig) error
+}
+
+type optionFunc func(config *setupConfig) error
+
+func (f optionFunc) apply(config *setupConfig) error {
+	return f(config)
+}
+
+// Environment forces the environment `Setup` uses to decide which exporters
+// to register.
+type Environment int
+
+const (
+	// EnvironmentAuto resolves the environment using `IsProductionEnvironment`.
+	EnvironmentAuto Environment = iota
+	// EnvironmentDevelopment registers exporters from environment variables.
+	EnvironmentDevelopment
+	// EnvironmentProduction registers the `StackDriver` exporter.
+	EnvironmentProduction
+)
+
+func (e Environment) String() string {
+	switch e {
+	case EnvironmentAuto:
+		return "auto"
+	case EnvironmentDevelopment:
+		return "development"
+	case EnvironmentProduction:
+		return "production"
+	default:
+		return fmt.Sprintf("Environment(%d)", int(e))
+	}
+}
+
+type setupConfig struct {
+	sampler           trace.Sampler
+	defaultAttributes TraceAttributes
+	exporters         []trace.Exporter
+	environment       *Environment
+	propagation       propagation.HTTPFormat
+	idGenerator       IDGenerator
+	spanLimits        *SpanLimits
+	samplingRules     *SamplingRules
+	projectID         string
+}
+
+func newSetupConfig(options []Option) (*setupConfig, error) {
+	config := &setupConfig{}
+	for _, option := range options {
+		if option == nil {
+			return nil, fmt.Errorf("invalid nil option")
+		}
+
+		if err := option.apply(config); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.sampler == nil {
+		rules, err := SamplingRulesFromEnv(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if rules != nil {
+			config.sampler = rules.Sampler()
+			config.samplingRules = rules
+		} else {
+			config.sampler = trace.ProbabilitySampler(1 / 4.0)
+		}
+	}
+
+	return config, nil
+}
+
+func (c *setupConfig) isProduction() bool {
+	if c.environment == nil || *c.environment == EnvironmentAuto {
+		return IsProductionEnvironment()
+	}
+
+	return *c.environment == EnvironmentProduction
+}
+
+// WithSampler sets `trace` default config `DefaultSampler` value to `sampler`. When not
+// specified, defaults to the sampling rules found in the environment (see
+// `SamplingRulesFromEnv`), or to a probability sampler of `1/4.0` otherwise.
+func WithSampler(sampler trace.Sampler) Option {
+	return optionFunc(func(config *setupConfig) error {
+		if sampler == nil {
+			return fmt.Errorf("sampler option must not be nil")
+		}
+
+		if config.sampler != nil {
+			return fmt.Errorf("conflicting sampler options, only one sampler can be specified")
+		}
+
+		config.sampler = sampler
+		return nil
+	})
+}
+
+// WithDefaultAttributes adds additional StackDriver default attributes. The
+// option can be specified multiple times, attributes are merged together, but
+// the same key cannot be given two different values.
+func WithDefaultAttributes(attributes TraceAttributes) Option {
+	return optionFunc(func(config *setupConfig) error {
+		if config.defaultAttributes == nil {
+			config.defaultAttributes = TraceAttributes{}
+		}
+
+		for key, value := range attributes {
+			if existing, found := config.defaultAttributes[key]; found && !reflect.DeepEqual(existing, value) {
+				return fmt.Errorf("conflicting default attribute %q, got both %v and %v", key, existing, value)
+			}
+
+			config.defaultAttributes[key] = value
+		}
+
+		return nil
+	})
+}
+
+// WithExporter registers `exporter` in addition to the exporters `Setup`
+// registers based on the environment. The exporter is flushed and
+// unregistered by the returned ShutdownFunc. The option can be specified
+// multiple times.
+func WithExporter(exporter trace.Exporter) Option {
+	return optionFunc(func(config *setupConfig) error {
+		if exporter == nil {
+			return fmt.Errorf("exporter option must not be nil")
+		}
+
+		config.exporters = append(config.exporters, exporter)
+		return nil
+	})
+}
+
+// WithEnvironment forces the environment instead of auto-detecting it through
+// `IsProductionEnvironment`.
+func WithEnvironment(environment Environment) Option {
+	return optionFunc(func(config *setupConfig) error {
+		switch environment {
+		case EnvironmentAuto, EnvironmentDevelopment, EnvironmentProduction:
+		default:
+			return fmt.Errorf("unknown environment %s", environment)
+		}
+
+		if config.environment != nil && *config.environment != environment {
+			return fmt.Errorf("conflicting environment options, got both %s and %s", *config.environment, environment)
+		}
+
+		config.environment = &environment
+		return nil
+	})
+}
+
+// WithPropagation sets the `propagation.HTTPFormat` used by the middleware
+// when none is explicitly provided to it.
+func WithPropagation(format propagation.HTTPFormat) Option {
+	return optionFunc(func(config *setupConfig) error {
+		if format == nil {
+			return fmt.Errorf("propagation option must not be nil")
+		}
+
+		if config.propagation != nil {
+			return fmt.Errorf("conflicting propagation options, only one propagation format can be specified")
+		}
+
+		config.propagation = format
+		return nil
+	})
+}
+
+// WithIDGenerator sets the generator used by OpenCensus and dtracing to create
+// trace and span IDs, see `SetIDGenerator`.
+func WithIDGenerator(generator IDGenerator) Option {
+	return optionFunc(func(config *setupConfig) error {
+		if generator == nil {
+			return fmt.Errorf("id generator option must not be nil")
+		}
+
+		if config.idGenerator != nil {
+			return fmt.Errorf("conflicting id generator options, only one id generator can be specified")
+		}
+
+		config.idGenerator = generator
+		return nil
+	})
+}
+
+// WithSpanLimits sets the limits on the data recorded on spans, see `SetSpanLimits`.
+// The exporters registered by `Setup`, including the ones given through `WithExporter`,
+// are wrapped in a `SpanLimitingExporter` so that data added directly on spans is also
+// limited.
+func WithSpanLimits(limits SpanLimits) Option {
+	return optionFunc(func(config *setupConfig) error {
+		if err := limits.validate(); err != nil {
+			return err
+		}
+
+		if config.spanLimits != nil {
+			return fmt.Errorf("conflicting span limits options, only one span limits can be specified")
+		}
+
+		config.spanLimits = &limits
+		return nil
+	})
+}
+
+// WithSamplingRules uses `rules` as the default sampler, see `SetDefaultSamplingRules`.
+// It cannot be combined with `WithSampler`.
+func WithSamplingRules(rules *SamplingRules) Option {
+	return optionFunc(func(config *setupConfig) error {
+		if rules == nil {
+			return fmt.Errorf("sampling rules option must not be nil")
+		}
+
+		if config.sampler != nil {
+			return fmt.Errorf("conflicting sampler options, only one sampler can be specified")
+		}
+
+		config.sampler = rules.Sampler()
+		config.samplingRules = rules
+		return nil
+	})
+}
+
+// WithProjectID sets the GCP project ID traces are exported to in production,
+// also used to link logs to their trace (see `LogFieldsFormatStackDriver`). When
+// not specified, the project of the application default credentials is used.
+func WithProjectID(projectID string) Option {
+	return optionFunc(func(config *setupConfig) error {
+		if projectID == "" {
+			return fmt.Errorf("project id option must not be empty")
+		}
+
+		if config.projectID != "" && config.projectID != projectID {
+			return fmt.Errorf("conflicting project id options, got both %s and %s", config.projectID, projectID)
+		}
+
+		config.projectID = projectID
+		return nil
+	})
+}
+
+// legacyOptionsToOptions converts the options accepted by `SetupTracing`, where
+// a raw `trace.Sampler` and `TraceAttributes` were accepted, to typed options.
+func legacyOptionsToOptions(legacyOptions []interface{}) ([]Option, error) {
+	options := make([]Option, len(legacyOptions))
+	for i, legacyOption := range legacyOptions {
+		switch v := legacyOption.(type) {
+		case Option:
+			options[i] = v
+		case trace.Sampler:
+			options[i] = WithSampler(v)
+		case TraceAttributes:
+			options[i] = WithDefaultAttributes(v)
+		default:
+			return nil, fmt.Errorf("unknown option of type %T at index %d", legacyOption, i)
+		}
+	}
+
+	return options, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+)
+
+func TestNewSetupConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       []interface{}
+		expectedError string
+	}{
+		{"no options", nil, ""},
+		{"legacy sampler and attributes", []interface{}{trace.AlwaysSample(), TraceAttributes{"a": 1}}, ""},
+		{"typed options", []interface{}{WithSampler(trace.NeverSample()), WithEnvironment(EnvironmentDevelopment)}, ""},
+		{"merged attributes", []interface{}{WithDefaultAttributes(TraceAttributes{"a": 1}), WithDefaultAttributes(TraceAttributes{"a": 1, "b": 2})}, ""},
+		{"unknown legacy option", []interface{}{"sampler"}, "unknown option of type string at index 0"},
+		{"conflicting samplers", []interface{}{trace.AlwaysSample(), WithSampler(trace.NeverSample())}, "conflicting sampler options, only one sampler can be specified"},
+		{"conflicting attributes", []interface{}{WithDefaultAttributes(TraceAttributes{"a": 1}), TraceAttributes{"a": 2}}, `conflicting default attribute "a", got both 1 and 2`},
+		{"conflicting environments", []interface{}{WithEnvironment(EnvironmentProduction), WithEnvironment(EnvironmentDevelopment)}, "conflicting environment options, got both production and development"},
+		{"unknown environment", []interface{}{WithEnvironment(Environment(10))}, "unknown environment Environment(10)"},
+		{"nil exporter", []interface{}{WithExporter(nil)}, "exporter option must not be nil"},
+		{"negative span limits", []interface{}{WithSpanLimits(SpanLimits{MaxLinks: -1})}, "span limits must not be negative"},
+		{"conflicting sampler and rules", []interface{}{trace.AlwaysSample(), WithSamplingRules(&SamplingRules{})}, "conflicting sampler options, only one sampler can be specified"},
+		{"nil sampling rules", []interface{}{WithSamplingRules(nil)}, "sampling rules option must not be nil"},
+		{"same project ids", []interface{}{WithProjectID("project"), WithProjectID("project")}, ""},
+		{"empty project id", []interface{}{WithProjectID("")}, "project id option must not be empty"},
+		{"conflicting project ids", []interface{}{WithProjectID("a"), WithProjectID("b")}, "conflicting project id options, got both a and b"},
+		{"conflicting span limits", []interface{}{WithSpanLimits(SpanLimits{}), WithSpanLimits(SpanLimits{MaxLinks: 1})}, "conflicting span limits options, only one span limits can be specified"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options, err := legacyOptionsToOptions(test.options)
+			if err == nil {
+				_, err = newSetupConfig(options)
+			}
+
+			if test.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
+
+func TestNewSetupConfig_DefaultSampler(t *testing.T) {
+	config, err := newSetupConfig(nil)
+	require.NoError(t, err)
+
+	assert.NotNil(t, config.sampler)
+	assert.Nil(t, config.environment)
+}
@@ -0,0 +1,584 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"go.uber.org/zap"
+	"google.golang.org/api/support/bundler"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const instrumentationLibraryName = "github.com/streamingfast/dtracing"
+
+// OTLPCompression defines the compression applied to OTLP export requests.
+type OTLPCompression int
+
+const (
+	OTLPCompressionNone OTLPCompression = iota
+	OTLPCompressionGzip
+)
+
+// OTLPOption configures an OTLP exporter, see the various `WithOTLP*` functions.
+type OTLPOption func(config *otlpConfig)
+
+type otlpConfig struct {
+	headers            map[string]string
+	compression        OTLPCompression
+	timeout            time.Duration
+	batchDelay         time.Duration
+	batchMaxSpans      int
+	bufferedSpansLimit int
+	retryMaxAttempts   int
+	retryInitialDelay  time.Duration
+	retryMaxDelay      time.Duration
+	resourceAttributes TraceAttributes
+	dialOptions        []grpc.DialOption
+	httpClient         *http.Client
+}
+
+// WithOTLPHeaders adds headers (gRPC metadata when using gRPC) to every export request.
+func WithOTLPHeaders(headers map[string]string) OTLPOption {
+	return func(config *otlpConfig) {
+		for key, value := range headers {
+			config.headers[key] = value
+		}
+	}
+}
+
+// WithOTLPCompression sets the compression of export requests, defaults to `OTLPCompressionGzip`.
+func WithOTLPCompression(compression OTLPCompression) OTLPOption {
+	return func(config *otlpConfig) {
+		config.compression = compression
+	}
+}
+
+// WithOTLPTimeout sets the maximum time a single export request can take, retries included,
+// defaults to 10s.
+func WithOTLPTimeout(timeout time.Duration) OTLPOption {
+	return func(config *otlpConfig) {
+		config.timeout = timeout
+	}
+}
+
+// WithOTLPBatching sets how spans are batched together, a batch is sent as soon as it
+// contains `maxSpans` spans or when `delay` elapsed since its first span was added.
+// Defaults to 512 spans and 5s.
+func WithOTLPBatching(maxSpans int, delay time.Duration) OTLPOption {
+	return func(config *otlpConfig) {
+		config.batchMaxSpans = maxSpans
+		config.batchDelay = delay
+	}
+}
+
+// WithOTLPBufferedSpansLimit sets the maximum number of spans waiting to be exported,
+// spans are dropped past this limit. Defaults to 8192 spans.
+func WithOTLPBufferedSpansLimit(limit int) OTLPOption {
+	return func(config *otlpConfig) {
+		config.bufferedSpansLimit = limit
+	}
+}
+
+// WithOTLPRetry configures the retry of failed export requests, using an exponential
+// backoff starting at `initialDelay` and capped at `maxDelay`. Only transient errors are
+// retried. Use a `maxAttempts` of 1 to disable retries. Defaults to 5 attempts, 100ms
+// and 5s.
+func WithOTLPRetry(maxAttempts int, initialDelay, maxDelay time.Duration) OTLPOption {
+	return func(config *otlpConfig) {
+		config.retryMaxAttempts = maxAttempts
+		config.retryInitialDelay = initialDelay
+		config.retryMaxDelay = maxDelay
+	}
+}
+
+// WithOTLPResourceAttributes adds attributes to the resource describing this process, by
+// default `service.name` and `host.name` are defined.
+func WithOTLPResourceAttributes(attributes TraceAttributes) OTLPOption {
+	return func(config *otlpConfig) {
+		for key, value := range attributes {
+			config.resourceAttributes[key] = value
+		}
+	}
+}
+
+// WithOTLPDialOptions adds gRPC dial options, only used for gRPC endpoints.
+func WithOTLPDialOptions(options ...grpc.DialOption) OTLPOption {
+	return func(config *otlpConfig) {
+		config.dialOptions = append(config.dialOptions, options...)
+	}
+}
+
+// WithOTLPHTTPClient sets the HTTP client used to send export requests, only used for
+// HTTP endpoints.
+func WithOTLPHTTPClient(client *http.Client) OTLPOption {
+	return func(config *otlpConfig) {
+		config.httpClient = client
+	}
+}
+
+// RegisterOTLPExporter registers an OTLP exporter that exports all traces to the
+// collector pointed by `endpoint`. The endpoint scheme selects the protocol:
+//
+//   - `grpc://host:port` for gRPC without TLS
+//   - `grpcs://host:port` for gRPC with TLS
+//   - `http://host:port[/path]` or `https://host:port[/path]` for HTTP/protobuf, the path
+//     defaults to `/v1/traces` when empty
+//
+// The returned ShutdownFunc unregisters the exporter, sends all pending spans and closes
+// the connection to the collector.
+func RegisterOTLPExporter(serviceName string, endpoint string, options ...OTLPOption) (ShutdownFunc, error) {
+	exporter, err := NewOTLPExporter(serviceName, endpoint, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return registerExporter(exporter), nil
+}
+
+// OTLPExporter is a `trace.Exporter` that sends spans in batches to an OTLP
+// collector.
+type OTLPExporter struct {
+	config   *otlpConfig
+	client   otlpClient
+	resource *resourcepb.Resource
+	bundler  *bundler.Bundler
+}
+
+// Compile time assertion that the exporter implements trace.Exporter
+var _ trace.Exporter = (*OTLPExporter)(nil)
+
+type otlpClient interface {
+	export(ctx context.Context, request *collectorpb.ExportTraceServiceRequest) error
+	close() error
+}
+
+// NewOTLPExporter creates an OTLP exporter without registering it, see
+// `RegisterOTLPExporter` for the accepted `endpoint` format.
+func NewOTLPExporter(serviceName string, endpoint string, options ...OTLPOption) (*OTLPExporter, error) {
+	config := &otlpConfig{
+		headers:            map[string]string{},
+		compression:        OTLPCompressionGzip,
+		timeout:            10 * time.Second,
+		batchDelay:         5 * time.Second,
+		batchMaxSpans:      512,
+		bufferedSpansLimit: 8192,
+		retryMaxAttempts:   5,
+		retryInitialDelay:  100 * time.Millisecond,
+		retryMaxDelay:      5 * time.Second,
+		resourceAttributes: TraceAttributes{"service.name": serviceName, "host.name": hostname},
+		httpClient:         http.DefaultClient,
+	}
+
+	for _, option := range options {
+		option(config)
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp exporter endpoint: %s", err)
+	}
+
+	var client otlpClient
+	switch endpointURL.Scheme {
+	case "grpc", "grpcs":
+		client, err = newOTLPGRPCClient(endpointURL, config)
+	case "http", "https":
+		client, err = newOTLPHTTPClient(endpointURL, config)
+	default:
+		return nil, fmt.Errorf("invalid otlp exporter endpoint %q, scheme must be one of grpc, grpcs, http or https", endpoint)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	exporter := &OTLPExporter{
+		config:   config,
+		client:   client,
+		resource: &resourcepb.Resource{Attributes: toOTLPAttributes(config.resourceAttributes)},
+	}
+
+	exporter.bundler = bundler.NewBundler((*trace.SpanData)(nil), func(bundle interface{}) {
+		exporter.exportSpans(bundle.([]*trace.SpanData))
+	})
+	exporter.bundler.DelayThreshold = config.batchDelay
+	exporter.bundler.BundleCountThreshold = config.batchMaxSpans
+	// The bundler works with sizes, each span accounts for a size of 1
+	exporter.bundler.BufferedByteLimit = config.bufferedSpansLimit
+
+	return exporter, nil
+}
+
+// ExportSpan queues the span for export, it's dropped if too many spans are
+// already waiting to be exported.
+func (e *OTLPExporter) ExportSpan(span *trace.SpanData) {
+	if err := e.bundler.Add(span, 1); err != nil {
+		zlog.Debug("dropping span, otlp exporter buffer is full", zap.String("name", span.Name), zap.Error(err))
+	}
+}
+
+// Flush waits for all queued spans to be exported.
+func (e *OTLPExporter) Flush() {
+	e.bundler.Flush()
+}
+
+// Close flushes all queued spans and closes the connection to the collector.
+func (e *OTLPExporter) Close() error {
+	e.bundler.Flush()
+	return e.client.close()
+}
+
+func (e *OTLPExporter) exportSpans(spans []*trace.SpanData) {
+	request := &collectorpb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{toOTLPResourceSpans(e.resource, spans)},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.config.timeout)
+	defer cancel()
+
+	delay := e.config.retryInitialDelay
+	for attempt := 1; ; attempt++ {
+		err := e.client.export(ctx, request)
+		if err == nil {
+			return
+		}
+
+		if attempt >= e.config.retryMaxAttempts || !isRetryableOTLPError(err) {
+			zlog.Info("failed to export spans to otlp collector", zap.Int("span_count", len(spans)), zap.Int("attempt", attempt), zap.Error(err))
+			return
+		}
+
+		zlog.Debug("retrying otlp export", zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			zlog.Info("failed to export spans to otlp collector", zap.Int("span_count", len(spans)), zap.Int("attempt", attempt), zap.Error(ctx.Err()))
+			return
+		}
+
+		delay *= 2
+		if delay > e.config.retryMaxDelay {
+			delay = e.config.retryMaxDelay
+		}
+	}
+}
+
+type otlpGRPCClient struct {
+	conn     *grpc.ClientConn
+	client   collectorpb.TraceServiceClient
+	metadata metadata.MD
+	callOpts []grpc.CallOption
+}
+
+func newOTLPGRPCClient(endpoint *url.URL, config *otlpConfig) (*otlpGRPCClient, error) {
+	dialOptions := []grpc.DialOption{grpc.WithInsecure()}
+	if endpoint.Scheme == "grpcs" {
+		dialOptions = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))}
+	}
+
+	conn, err := grpc.Dial(endpoint.Host, append(dialOptions, config.dialOptions...)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial otlp collector %q: %s", endpoint.Host, err)
+	}
+
+	var callOpts []grpc.CallOption
+	if config.compression == OTLPCompressionGzip {
+		callOpts = append(callOpts, grpc.UseCompressor("gzip"))
+	}
+
+	return &otlpGRPCClient{
+		conn:     conn,
+		client:   collectorpb.NewTraceServiceClient(conn),
+		metadata: metadata.New(config.headers),
+		callOpts: callOpts,
+	}, nil
+}
+
+func (c *otlpGRPCClient) export(ctx context.Context, request *collectorpb.ExportTraceServiceRequest) error {
+	if len(c.metadata) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, c.metadata)
+	}
+
+	_, err := c.client.Export(ctx, request, c.callOpts...)
+	return err
+}
+
+func (c *otlpGRPCClient) close() error {
+	return c.conn.Close()
+}
+
+type otlpHTTPClient struct {
+	url        string
+	headers    map[string]string
+	gzip       bool
+	httpClient *http.Client
+}
+
+type otlpHTTPError struct {
+	statusCode int
+	body       string
+}
+
+func (e *otlpHTTPError) Error() string {
+	return fmt.Sprintf("otlp collector responded with status %d: %s", e.statusCode, e.body)
+}
+
+func newOTLPHTTPClient(endpoint *url.URL, config *otlpConfig) (*otlpHTTPClient, error) {
+	exportURL := *endpoint
+	if exportURL.Path == "" || exportURL.Path == "/" {
+		exportURL.Path = "/v1/traces"
+	}
+
+	return &otlpHTTPClient{
+		url:        exportURL.String(),
+		headers:    config.headers,
+		gzip:       config.compression == OTLPCompressionGzip,
+		httpClient: config.httpClient,
+	}, nil
+}
+
+func (c *otlpHTTPClient) export(ctx context.Context, request *collectorpb.ExportTraceServiceRequest) error {
+	payload, err := proto.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("unable to marshal otlp request: %s", err)
+	}
+
+	if c.gzip {
+		buffer := bytes.NewBuffer(nil)
+		writer := gzip.NewWriter(buffer)
+		if _, err := writer.Write(payload); err != nil {
+			return fmt.Errorf("unable to compress otlp request: %s", err)
+		}
+
+		if err := writer.Close(); err != nil {
+			return fmt.Errorf("unable to compress otlp request: %s", err)
+		}
+
+		payload = buffer.Bytes()
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("unable to create otlp request: %s", err)
+	}
+
+	httpRequest.Header.Set("Content-Type", "application/x-protobuf")
+	if c.gzip {
+		httpRequest.Header.Set("Content-Encoding", "gzip")
+	}
+
+	for key, value := range c.headers {
+		httpRequest.Header.Set(key, value)
+	}
+
+	response, err := c.httpClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		io.Copy(ioutil.Discard, response.Body)
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return &otlpHTTPError{statusCode: response.StatusCode, body: strings.TrimSpace(string(body))}
+}
+
+func (c *otlpHTTPClient) close() error {
+	return nil
+}
+
+func isRetryableOTLPError(err error) bool {
+	var httpErr *otlpHTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.statusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+
+		return false
+	}
+
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+			return true
+		}
+
+		return false
+	}
+
+	// Any other error is a transport error (connection refused, reset, etc.) worth retrying
+	return true
+}
+
+func toOTLPResourceSpans(resource *resourcepb.Resource, spans []*trace.SpanData) *tracepb.ResourceSpans {
+	otlpSpans := make([]*tracepb.Span, len(spans))
+	for i, span := range spans {
+		otlpSpans[i] = toOTLPSpan(span)
+	}
+
+	return &tracepb.ResourceSpans{
+		Resource: resource,
+		InstrumentationLibrarySpans: []*tracepb.InstrumentationLibrarySpans{
+			{
+				InstrumentationLibrary: &commonpb.InstrumentationLibrary{Name: instrumentationLibraryName},
+				Spans:                  otlpSpans,
+			},
+		},
+	}
+}
+
+func toOTLPSpan(span *trace.SpanData) *tracepb.Span {
+	out := &tracepb.Span{
+		TraceId:                span.TraceID[:],
+		SpanId:                 span.SpanID[:],
+		Name:                   span.Name,
+		Kind:                   toOTLPSpanKind(span.SpanKind),
+		StartTimeUnixNano:      uint64(span.StartTime.UnixNano()),
+		EndTimeUnixNano:        uint64(span.EndTime.UnixNano()),
+		Attributes:             toOTLPAttributes(span.Attributes),
+		DroppedAttributesCount: uint32(span.DroppedAttributeCount),
+		DroppedEventsCount:     uint32(span.DroppedAnnotationCount + span.DroppedMessageEventCount),
+		DroppedLinksCount:      uint32(span.DroppedLinkCount),
+		Status:                 toOTLPStatus(span.Status),
+		TraceState:             formatTracestate(span.Tracestate),
+	}
+
+	if span.ParentSpanID != (trace.SpanID{}) {
+		out.ParentSpanId = span.ParentSpanID[:]
+	}
+
+	for _, annotation := range span.Annotations {
+		out.Events = append(out.Events, &tracepb.Span_Event{
+			TimeUnixNano: uint64(annotation.Time.UnixNano()),
+			Name:         annotation.Message,
+			Attributes:   toOTLPAttributes(annotation.Attributes),
+		})
+	}
+
+	for _, event := range span.MessageEvents {
+		out.Events = append(out.Events, &tracepb.Span_Event{
+			TimeUnixNano: uint64(event.Time.UnixNano()),
+			Name:         "message",
+			Attributes: toOTLPAttributes(map[string]interface{}{
+				"message.type":              messageEventTypeName(event.EventType),
+				"message.id":                event.MessageID,
+				"message.uncompressed_size": event.UncompressedByteSize,
+				"message.compressed_size":   event.CompressedByteSize,
+			}),
+		})
+	}
+
+	for _, link := range span.Links {
+		traceID, spanID := link.TraceID, link.SpanID
+		out.Links = append(out.Links, &tracepb.Span_Link{
+			TraceId:    traceID[:],
+			SpanId:     spanID[:],
+			Attributes: toOTLPAttributes(link.Attributes),
+		})
+	}
+
+	return out
+}
+
+func toOTLPSpanKind(kind int) tracepb.Span_SpanKind {
+	switch kind {
+	case trace.SpanKindServer:
+		return tracepb.Span_SPAN_KIND_SERVER
+	case trace.SpanKindClient:
+		return tracepb.Span_SPAN_KIND_CLIENT
+	default:
+		return tracepb.Span_SPAN_KIND_INTERNAL
+	}
+}
+
+// toOTLPStatus maps the OpenCensus status, which uses gRPC codes, to the OTLP status. Since
+// OpenCensus code `0` is both the default and `OK`, it's mapped to `UNSET`.
+func toOTLPStatus(s trace.Status) *tracepb.Status {
+	if s.Code == 0 {
+		return &tracepb.Status{Code: tracepb.Status_STATUS_CODE_UNSET, Message: s.Message}
+	}
+
+	return &tracepb.Status{
+		Code:           tracepb.Status_STATUS_CODE_ERROR,
+		DeprecatedCode: tracepb.Status_DeprecatedStatusCode(s.Code),
+		Message:        s.Message,
+	}
+}
+
+func toOTLPAttributes(attributes map[string]interface{}) []*commonpb.KeyValue {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	out := make([]*commonpb.KeyValue, 0, len(attributes))
+	for key, value := range attributes {
+		out = append(out, &commonpb.KeyValue{Key: key, Value: toOTLPAnyValue(value)})
+	}
+
+	return out
+}
+
+func toOTLPAnyValue(value interface{}) *commonpb.AnyValue {
+	switch v := value.(type) {
+	case string:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v}}
+	case int64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v}}
+	case float64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v}}
+	default:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprintf("%v", v)}}
+	}
+}
+
+func messageEventTypeName(eventType trace.MessageEventType) string {
+	switch eventType {
+	case trace.MessageEventTypeSent:
+		return "SENT"
+	case trace.MessageEventTypeRecv:
+		return "RECEIVED"
+	default:
+		return "UNSPECIFIED"
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+type fakeOTLPReceiver struct {
+	collectorpb.UnimplementedTraceServiceServer
+
+	lock     sync.Mutex
+	requests []*collectorpb.ExportTraceServiceRequest
+	headers  []metadata.MD
+}
+
+func (r *fakeOTLPReceiver) Export(ctx context.Context, request *collectorpb.ExportTraceServiceRequest) (*collectorpb.ExportTraceServiceResponse, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.requests = append(r.requests, request)
+	r.headers = append(r.headers, md)
+
+	return &collectorpb.ExportTraceServiceResponse{}, nil
+}
+
+func (r *fakeOTLPReceiver) spans() (out []*tracepb.Span) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, request := range r.requests {
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, librarySpans := range resourceSpans.InstrumentationLibrarySpans {
+				out = append(out, librarySpans.Spans...)
+			}
+		}
+	}
+
+	return
+}
+
+func TestOTLPExporter_GRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	receiver := &fakeOTLPReceiver{}
+	server := grpc.NewServer()
+	collectorpb.RegisterTraceServiceServer(server, receiver)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	exporter, err := NewOTLPExporter("test", "grpc://"+listener.Addr().String(), WithOTLPHeaders(map[string]string{"x-api-key": "secret"}))
+	require.NoError(t, err)
+
+	exporter.ExportSpan(testOTLPSpanData())
+	require.NoError(t, exporter.Close())
+
+	spans := receiver.spans()
+	require.Len(t, spans, 1)
+	assertOTLPSpan(t, spans[0])
+
+	assert.Equal(t, []string{"secret"}, receiver.headers[0].Get("x-api-key"))
+
+	resourceAttributes := map[string]string{}
+	for _, attribute := range receiver.requests[0].ResourceSpans[0].Resource.Attributes {
+		resourceAttributes[attribute.Key] = attribute.Value.GetStringValue()
+	}
+
+	assert.Equal(t, "test", resourceAttributes["service.name"])
+}
+
+func TestOTLPExporter_HTTP(t *testing.T) {
+	var lock sync.Mutex
+	var requests []*collectorpb.ExportTraceServiceRequest
+	var calls int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+
+		reader, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+
+		payload, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+
+		request := &collectorpb.ExportTraceServiceRequest{}
+		require.NoError(t, proto.Unmarshal(payload, request))
+		requests = append(requests, request)
+	}))
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter("test", server.URL, WithOTLPRetry(3, time.Millisecond, time.Millisecond))
+	require.NoError(t, err)
+
+	exporter.ExportSpan(testOTLPSpanData())
+	require.NoError(t, exporter.Close())
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	assert.Equal(t, 2, calls)
+	require.Len(t, requests, 1)
+	assertOTLPSpan(t, requests[0].ResourceSpans[0].InstrumentationLibrarySpans[0].Spans[0])
+}
+
+func TestNewOTLPExporter_InvalidScheme(t *testing.T) {
+	_, err := NewOTLPExporter("test", "ftp://localhost:4317")
+	assert.EqualError(t, err, `invalid otlp exporter endpoint "ftp://localhost:4317", scheme must be one of grpc, grpcs, http or https`)
+}
+
+func testOTLPSpanData() *trace.SpanData {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	return &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID: NewFixedTraceID("000102030405060708090a0b0c0d0e0f"),
+			SpanID:  trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		},
+		SpanKind:    trace.SpanKindServer,
+		Name:        "operation",
+		StartTime:   start,
+		EndTime:     start.Add(time.Second),
+		Attributes:  map[string]interface{}{"count": int64(2)},
+		Annotations: []trace.Annotation{{Time: start, Message: "started"}},
+		Status:      trace.Status{Code: trace.StatusCodeNotFound, Message: "not found"},
+	}
+}
+
+func assertOTLPSpan(t *testing.T, span *tracepb.Span) {
+	t.Helper()
+
+	assert.Equal(t, "operation", span.Name)
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, span.TraceId)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, span.SpanId)
+	assert.Nil(t, span.ParentSpanId)
+	assert.Equal(t, tracepb.Span_SPAN_KIND_SERVER, span.Kind)
+	assert.Equal(t, uint64(time.Second), span.EndTimeUnixNano-span.StartTimeUnixNano)
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, span.Status.Code)
+	assert.Equal(t, "not found", span.Status.Message)
+	require.Len(t, span.Attributes, 1)
+	assert.Equal(t, int64(2), span.Attributes[0].Value.GetIntValue())
+	require.Len(t, span.Events, 1)
+	assert.Equal(t, "started", span.Events[0].Name)
+}
@@ -0,0 +1,320 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	strackdriverPropagation "contrib.go.opencensus.io/exporter/stackdriver/propagation"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"go.opencensus.io/trace/tracestate"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+
+	b3Header        = "b3"
+	b3TraceIDHeader = "X-B3-TraceId"
+	b3SpanIDHeader  = "X-B3-SpanId"
+	b3SampledHeader = "X-B3-Sampled"
+	b3FlagsHeader   = "X-B3-Flags"
+
+	maxTracestateEntries = 32
+)
+
+// NewDefaultCompositeFormat returns the format used by default by the middleware,
+// it extracts the span context trying in order W3C Trace Context, B3 (single and
+// multi-header) and StackDriver formats, and injects all of them.
+func NewDefaultCompositeFormat() *CompositeFormat {
+	return NewCompositeFormat(&TraceContextFormat{}, &B3Format{}, &strackdriverPropagation.HTTPFormat{})
+}
+
+// CompositeFormat is a `propagation.HTTPFormat` that delegates to multiple formats.
+// On extraction, formats are tried in order and the first one able to extract the
+// span context wins. On injection, all formats write their headers so that the
+// downstream service understands at least one of them.
+type CompositeFormat struct {
+	formats []propagation.HTTPFormat
+}
+
+// Compile time assertion that the format implements propagation.HTTPFormat
+var _ propagation.HTTPFormat = (*CompositeFormat)(nil)
+
+// NewCompositeFormat returns a format trying each of `formats` in the order received.
+func NewCompositeFormat(formats ...propagation.HTTPFormat) *CompositeFormat {
+	return &CompositeFormat{formats: formats}
+}
+
+func (f *CompositeFormat) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	for _, format := range f.formats {
+		if sc, ok := format.SpanContextFromRequest(req); ok {
+			return sc, true
+		}
+	}
+
+	return trace.SpanContext{}, false
+}
+
+func (f *CompositeFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	for _, format := range f.formats {
+		format.SpanContextToRequest(sc, req)
+	}
+}
+
+// TraceContextFormat is a `propagation.HTTPFormat` implementing the W3C Trace Context
+// specification, using the `traceparent` and `tracestate` headers.
+type TraceContextFormat struct{}
+
+// Compile time assertion that the format implements propagation.HTTPFormat
+var _ propagation.HTTPFormat = (*TraceContextFormat)(nil)
+
+func (f *TraceContextFormat) SpanContextFromRequest(req *http.Request) (sc trace.SpanContext, ok bool) {
+	sc, ok = parseTraceparent(req.Header.Get(traceparentHeader))
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+
+	sc.Tracestate = parseTracestate(req.Header[http.CanonicalHeaderKey(tracestateHeader)])
+	return sc, true
+}
+
+func (f *TraceContextFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	req.Header.Set(traceparentHeader, FormatTraceparent(sc))
+
+	if value := formatTracestate(sc.Tracestate); value != "" {
+		req.Header.Set(tracestateHeader, value)
+	}
+}
+
+func formatTracestate(ts *tracestate.Tracestate) string {
+	if ts == nil {
+		return ""
+	}
+
+	entries := ts.Entries()
+	pairs := make([]string, len(entries))
+	for i, entry := range entries {
+		pairs[i] = entry.Key + "=" + entry.Value
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// parseTraceparent parses a W3C `traceparent` header value of the form
+// `<version>-<trace-id>-<parent-id>-<trace-flags>`.
+func parseTraceparent(value string) (sc trace.SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, false
+	}
+
+	version, ok := parseHexByte(parts[0])
+	if !ok || version == 0xff || (version == 0 && len(parts) != 4) {
+		return sc, false
+	}
+
+	if sc.TraceID, ok = parseHexTraceID(parts[1]); !ok || sc.TraceID == (trace.TraceID{}) {
+		return sc, false
+	}
+
+	if sc.SpanID, ok = parseHexSpanID(parts[2]); !ok || sc.SpanID == (trace.SpanID{}) {
+		return sc, false
+	}
+
+	flags, ok := parseHexByte(parts[3])
+	if !ok {
+		return sc, false
+	}
+
+	sc.TraceOptions = trace.TraceOptions(flags & 0x01)
+	return sc, true
+}
+
+// parseTracestate parses W3C `tracestate` header values, returning nil when the values
+// are invalid, in which case the specification mandates to discard them.
+func parseTracestate(values []string) *tracestate.Tracestate {
+	var entries []tracestate.Entry
+	for _, value := range values {
+		for _, member := range strings.Split(value, ",") {
+			member = strings.TrimSpace(member)
+			if member == "" {
+				continue
+			}
+
+			equalIndex := strings.Index(member, "=")
+			if equalIndex <= 0 {
+				return nil
+			}
+
+			entries = append(entries, tracestate.Entry{Key: member[:equalIndex], Value: member[equalIndex+1:]})
+		}
+	}
+
+	if len(entries) == 0 || len(entries) > maxTracestateEntries {
+		return nil
+	}
+
+	ts, err := tracestate.New(nil, entries...)
+	if err != nil {
+		return nil
+	}
+
+	return ts
+}
+
+// B3Format is a `propagation.HTTPFormat` implementing Zipkin B3 propagation. Both the
+// single `b3` header and the multiple `X-B3-*` headers are understood on extraction,
+// the single header having precedence. On injection, the multiple headers are written
+// unless `SingleHeader` is true.
+type B3Format struct {
+	SingleHeader bool
+}
+
+// Compile time assertion that the format implements propagation.HTTPFormat
+var _ propagation.HTTPFormat = (*B3Format)(nil)
+
+func (f *B3Format) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	if value := req.Header.Get(b3Header); value != "" {
+		return parseB3SingleHeader(value)
+	}
+
+	traceID, ok := parseB3TraceID(req.Header.Get(b3TraceIDHeader))
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+
+	spanID, ok := parseHexSpanID(req.Header.Get(b3SpanIDHeader))
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+
+	sampled := parseB3Sampled(req.Header.Get(b3SampledHeader)) || req.Header.Get(b3FlagsHeader) == "1"
+
+	return newSpanContext(traceID, spanID, sampled), true
+}
+
+func (f *B3Format) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	traceID := hex.EncodeToString(sc.TraceID[:])
+	spanID := hex.EncodeToString(sc.SpanID[:])
+	sampled := "0"
+	if sc.IsSampled() {
+		sampled = "1"
+	}
+
+	if f.SingleHeader {
+		req.Header.Set(b3Header, traceID+"-"+spanID+"-"+sampled)
+		return
+	}
+
+	req.Header.Set(b3TraceIDHeader, traceID)
+	req.Header.Set(b3SpanIDHeader, spanID)
+	req.Header.Set(b3SampledHeader, sampled)
+}
+
+// parseB3SingleHeader parses a `b3` header value of the form
+// `<trace-id>-<span-id>[-<sampling>[-<parent-span-id>]]`. A value containing only
+// the sampling state carries no span context and is rejected.
+func parseB3SingleHeader(value string) (trace.SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		return trace.SpanContext{}, false
+	}
+
+	traceID, ok := parseB3TraceID(parts[0])
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+
+	spanID, ok := parseHexSpanID(parts[1])
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+
+	sampled := false
+	if len(parts) >= 3 {
+		sampled = parts[2] == "d" || parseB3Sampled(parts[2])
+	}
+
+	return newSpanContext(traceID, spanID, sampled), true
+}
+
+// parseB3TraceID parses a B3 trace id which is either 128-bit or 64-bit, in which
+// case it's left padded with zeros.
+func parseB3TraceID(value string) (trace.TraceID, bool) {
+	if len(value) == 16 {
+		value = strings.Repeat("0", 16) + value
+	}
+
+	traceID, ok := parseHexTraceID(value)
+	if !ok || traceID == (trace.TraceID{}) {
+		return traceID, false
+	}
+
+	return traceID, true
+}
+
+func parseB3Sampled(value string) bool {
+	return value == "1" || value == "true"
+}
+
+func newSpanContext(traceID trace.TraceID, spanID trace.SpanID, sampled bool) trace.SpanContext {
+	sc := trace.SpanContext{TraceID: traceID, SpanID: spanID}
+	if sampled {
+		sc.TraceOptions = 1
+	}
+
+	return sc
+}
+
+func parseHexTraceID(value string) (out trace.TraceID, ok bool) {
+	if len(value) != 32 {
+		return out, false
+	}
+
+	if _, err := hex.Decode(out[:], []byte(value)); err != nil {
+		return out, false
+	}
+
+	return out, true
+}
+
+func parseHexSpanID(value string) (out trace.SpanID, ok bool) {
+	if len(value) != 16 {
+		return out, false
+	}
+
+	if _, err := hex.Decode(out[:], []byte(value)); err != nil {
+		return out, false
+	}
+
+	return out, true
+}
+
+func parseHexByte(value string) (byte, bool) {
+	var out [1]byte
+	if len(value) != 2 {
+		return 0, false
+	}
+
+	if _, err := hex.Decode(out[:], []byte(value)); err != nil {
+		return 0, false
+	}
+
+	return out[0], true
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
+)
+
+func TestDefaultCompositeFormat_SpanContextFromRequest(t *testing.T) {
+	traceID := NewFixedTraceID("0af7651916cd43dd8448eb211c80319c")
+	spanID := trace.SpanID{0xb7, 0xad, 0x6b, 0x71, 0x69, 0x20, 0x33, 0x31}
+	shortTraceID := NewFixedTraceID("00000000000000008448eb211c80319c")
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected trace.SpanContext
+		ok       bool
+	}{
+		{"no headers", nil, trace.SpanContext{}, false},
+		{
+			"w3c sampled",
+			map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+			trace.SpanContext{TraceID: traceID, SpanID: spanID, TraceOptions: 1},
+			true,
+		},
+		{
+			"w3c not sampled",
+			map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"},
+			trace.SpanContext{TraceID: traceID, SpanID: spanID},
+			true,
+		},
+		{
+			"w3c future version with extra fields",
+			map[string]string{"traceparent": "01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra"},
+			trace.SpanContext{TraceID: traceID, SpanID: spanID, TraceOptions: 1},
+			true,
+		},
+		{"w3c invalid version", map[string]string{"traceparent": "ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}, trace.SpanContext{}, false},
+		{"w3c zero trace id", map[string]string{"traceparent": "00-00000000000000000000000000000000-b7ad6b7169203331-01"}, trace.SpanContext{}, false},
+		{
+			"b3 single",
+			map[string]string{"b3": "0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-1"},
+			trace.SpanContext{TraceID: traceID, SpanID: spanID, TraceOptions: 1},
+			true,
+		},
+		{
+			"b3 single short trace id with parent",
+			map[string]string{"b3": "8448eb211c80319c-b7ad6b7169203331-0-00f067aa0ba902b7"},
+			trace.SpanContext{TraceID: shortTraceID, SpanID: spanID},
+			true,
+		},
+		{"b3 single sampling only", map[string]string{"b3": "1"}, trace.SpanContext{}, false},
+		{
+			"b3 multi",
+			map[string]string{"X-B3-TraceId": "0af7651916cd43dd8448eb211c80319c", "X-B3-SpanId": "b7ad6b7169203331", "X-B3-Sampled": "1"},
+			trace.SpanContext{TraceID: traceID, SpanID: spanID, TraceOptions: 1},
+			true,
+		},
+		{
+			"b3 multi debug",
+			map[string]string{"X-B3-TraceId": "0af7651916cd43dd8448eb211c80319c", "X-B3-SpanId": "b7ad6b7169203331", "X-B3-Flags": "1"},
+			trace.SpanContext{TraceID: traceID, SpanID: spanID, TraceOptions: 1},
+			true,
+		},
+		{
+			"stackdriver",
+			map[string]string{"X-Cloud-Trace-Context": "0af7651916cd43dd8448eb211c80319c/13235353014750950193;o=1"},
+			trace.SpanContext{TraceID: traceID, SpanID: spanID, TraceOptions: 1},
+			true,
+		},
+		{
+			"w3c has priority over stackdriver",
+			map[string]string{
+				"traceparent":           "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+				"X-Cloud-Trace-Context": "00000000000000000000000000000001/1;o=0",
+			},
+			trace.SpanContext{TraceID: traceID, SpanID: spanID, TraceOptions: 1},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			for key, value := range test.headers {
+				req.Header.Set(key, value)
+			}
+
+			sc, ok := NewDefaultCompositeFormat().SpanContextFromRequest(req)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.expected, sc)
+		})
+	}
+}
+
+func TestTraceContextFormat_Tracestate(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	req.Header.Add("tracestate", "congo=t61rcWkgMzE")
+	req.Header.Add("tracestate", "rojo=00f067aa0ba902b7")
+
+	format := &TraceContextFormat{}
+	sc, ok := format.SpanContextFromRequest(req)
+	assert.True(t, ok)
+
+	out := httptest.NewRequest("GET", "/", nil)
+	format.SpanContextToRequest(sc, out)
+
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", out.Header.Get("traceparent"))
+	assert.Equal(t, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7", out.Header.Get("tracestate"))
+}
+
+func TestCompositeFormat_SpanContextToRequest(t *testing.T) {
+	sc := trace.SpanContext{
+		TraceID:      NewFixedTraceID("0af7651916cd43dd8448eb211c80319c"),
+		SpanID:       trace.SpanID{0xb7, 0xad, 0x6b, 0x71, 0x69, 0x20, 0x33, 0x31},
+		TraceOptions: 1,
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	NewCompositeFormat(&TraceContextFormat{}, &B3Format{SingleHeader: true}).SpanContextToRequest(sc, req)
+
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", req.Header.Get("traceparent"))
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-1", req.Header.Get("b3"))
+}
@@ -20,17 +20,154 @@ import (
 	"math/rand"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/trace"
 )
 
+// IDGenerator generates trace and span IDs, implementations must be safe for
+// concurrent use and must never return zero IDs.
+type IDGenerator interface {
+	NewTraceID() [16]byte
+	NewSpanID() [8]byte
+}
+
+// idGeneratorHolder wraps the current generator since `atomic.Value` requires all
+// stored values to be of the same concrete type.
+type idGeneratorHolder struct {
+	generator IDGenerator
+}
+
+var currentIDGenerator atomic.Value // access atomically
+
+func init() {
+	currentIDGenerator.Store(idGeneratorHolder{newDefaultIDGenerator()})
+}
+
+// SetIDGenerator replaces the generator used by `GetTraceID`, `NewRandomTraceID`,
+// `NewZeroedTraceIDInContext`, `NewFixedTraceIDInContext` and the middleware. The
+// generator is also installed in OpenCensus so that started spans use it too.
+func SetIDGenerator(generator IDGenerator) {
+	if generator == nil {
+		panic("id generator must not be nil")
+	}
+
+	currentIDGenerator.Store(idGeneratorHolder{generator})
+	trace.ApplyConfig(trace.Config{IDGenerator: generator})
+}
+
+func getIDGenerator() IDGenerator {
+	return currentIDGenerator.Load().(idGeneratorHolder).generator
+}
+
+// NewCryptoIDGenerator returns a generator reading every ID from `crypto/rand`. It's
+// slower than the default generator but IDs are unpredictable.
+func NewCryptoIDGenerator() IDGenerator {
+	return cryptoIDGenerator{}
+}
+
+type cryptoIDGenerator struct{}
+
+func (cryptoIDGenerator) NewTraceID() (tid [16]byte) {
+	for tid == ([16]byte{}) {
+		readCryptoRandom(tid[:])
+	}
+	return
+}
+
+func (cryptoIDGenerator) NewSpanID() (sid [8]byte) {
+	for sid == ([8]byte{}) {
+		readCryptoRandom(sid[:])
+	}
+	return
+}
+
+func readCryptoRandom(out []byte) {
+	if _, err := crand.Read(out); err != nil {
+		panic(err)
+	}
+}
+
+// NewSeededIDGenerator returns a deterministic generator, the same `seed` always
+// yields the same sequence of IDs. This should be used only in testing to get
+// reproducible trace and span IDs.
+func NewSeededIDGenerator(seed int64) IDGenerator {
+	return &seededIDGenerator{random: rand.New(rand.NewSource(seed))}
+}
+
+type seededIDGenerator struct {
+	sync.Mutex
+	random *rand.Rand
+}
+
+func (gen *seededIDGenerator) NewTraceID() (tid [16]byte) {
+	gen.Lock()
+	defer gen.Unlock()
+
+	for tid == ([16]byte{}) {
+		gen.random.Read(tid[:])
+	}
+	return
+}
+
+func (gen *seededIDGenerator) NewSpanID() (sid [8]byte) {
+	gen.Lock()
+	defer gen.Unlock()
+
+	for sid == ([8]byte{}) {
+		gen.random.Read(sid[:])
+	}
+	return
+}
+
+// NewTimeOrderedIDGenerator returns a generator whose trace IDs sort by creation
+// time. The first 8 bytes of the trace ID are the big-endian creation time in
+// nanoseconds since the epoch, kept strictly increasing within the process, and
+// the last 8 bytes are random. Span IDs are random.
+func NewTimeOrderedIDGenerator() IDGenerator {
+	return &timeOrderedIDGenerator{now: time.Now}
+}
+
+type timeOrderedIDGenerator struct {
+	// Please keep as the first field so it's 8 bytes aligned for atomic accesses
+	lastTimestamp uint64
+
+	now    func() time.Time
+	random cryptoIDGenerator
+}
+
+func (gen *timeOrderedIDGenerator) NewTraceID() (tid [16]byte) {
+	binary.BigEndian.PutUint64(tid[0:8], gen.nextTimestamp())
+	readCryptoRandom(tid[8:16])
+	return
+}
+
+func (gen *timeOrderedIDGenerator) nextTimestamp() uint64 {
+	now := uint64(gen.now().UnixNano())
+	for {
+		last := atomic.LoadUint64(&gen.lastTimestamp)
+		next := now
+		if next <= last {
+			next = last + 1
+		}
+
+		if atomic.CompareAndSwapUint64(&gen.lastTimestamp, last, next) {
+			return next
+		}
+	}
+}
+
+func (gen *timeOrderedIDGenerator) NewSpanID() [8]byte {
+	return gen.random.NewSpanID()
+}
+
 // Copied straight from https://github.com/census-instrumentation/opencensus-go/blob/master/trace/trace.go#L534..L598
 //
 // With slight modifications to only keep stuff around ID generation
 // since it's not exposed publicly, this implementation is good enough
 // anyway.
 
-var config atomic.Value // access atomically
-
-func init() {
+func newDefaultIDGenerator() *defaultIDGenerator {
 	gen := &defaultIDGenerator{}
 	// initialize traceID and spanID generators.
 	var rngSeed int64
@@ -42,7 +179,7 @@ func init() {
 	gen.traceIDRand = rand.New(rand.NewSource(rngSeed))
 	gen.spanIDInc |= 1
 
-	config.Store(gen)
+	return gen
 }
 
 type defaultIDGenerator struct {
@@ -0,0 +1,74 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
+)
+
+func TestSetIDGenerator(t *testing.T) {
+	defer SetIDGenerator(newDefaultIDGenerator())
+
+	SetIDGenerator(NewSeededIDGenerator(1))
+	expected := NewSeededIDGenerator(1)
+
+	assert.Equal(t, trace.TraceID(expected.NewTraceID()), NewRandomTraceID())
+	assert.Equal(t, trace.TraceID(expected.NewTraceID()), GetTraceID(context.Background()))
+
+	_, span := trace.StartSpan(context.Background(), "span", trace.WithSampler(trace.NeverSample()))
+	assert.Equal(t, trace.TraceID(expected.NewTraceID()), span.SpanContext().TraceID)
+	assert.Equal(t, trace.SpanID(expected.NewSpanID()), span.SpanContext().SpanID)
+}
+
+func TestSeededIDGenerator(t *testing.T) {
+	first, second := NewSeededIDGenerator(42), NewSeededIDGenerator(42)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first.NewTraceID(), second.NewTraceID())
+		assert.Equal(t, first.NewSpanID(), second.NewSpanID())
+	}
+
+	assert.NotEqual(t, NewSeededIDGenerator(1).NewTraceID(), NewSeededIDGenerator(2).NewTraceID())
+}
+
+func TestCryptoIDGenerator(t *testing.T) {
+	generator := NewCryptoIDGenerator()
+
+	assert.NotEqual(t, [16]byte{}, generator.NewTraceID())
+	assert.NotEqual(t, [8]byte{}, generator.NewSpanID())
+	assert.NotEqual(t, generator.NewTraceID(), generator.NewTraceID())
+}
+
+func TestTimeOrderedIDGenerator(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	generator := &timeOrderedIDGenerator{now: func() time.Time { return now }}
+
+	first := generator.NewTraceID()
+	second := generator.NewTraceID()
+	now = now.Add(time.Second)
+	third := generator.NewTraceID()
+
+	assert.Equal(t, -1, bytes.Compare(first[:], second[:]), "same clock reading must still be ordered")
+	assert.Equal(t, -1, bytes.Compare(second[:], third[:]))
+
+	now = now.Add(-time.Hour)
+	fourth := generator.NewTraceID()
+	assert.Equal(t, -1, bytes.Compare(third[:], fourth[:]), "clock going backward must still be ordered")
+}
@@ -0,0 +1,360 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"go.opencensus.io/trace"
+)
+
+// RedactedValue is the value replacing masked data.
+const RedactedValue = "[REDACTED]"
+
+// RedactionAction is what happens to data matched by a `RedactionRule`.
+type RedactionAction int
+
+const (
+	// RedactionMask replaces the matched data with `RedactedValue`.
+	RedactionMask RedactionAction = iota
+
+	// RedactionHash replaces the matched data with `hmac-sha256:` followed by the first 16
+	// hexadecimal characters of its HMAC-SHA256 using the redactor's hash key (see
+	// `Redactor.WithHashKey`), so that equal values can still be correlated.
+	//
+	// Without a secret key, hashing is not anonymisation: low entropy values (emails,
+	// user IDs, card numbers, ...) are easily recovered by hashing candidate values.
+	RedactionHash
+
+	// RedactionDrop removes the matched attribute, or the matched text from annotation
+	// messages.
+	RedactionDrop
+)
+
+var (
+	// EmailPattern matches email addresses.
+	EmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+	// BearerTokenPattern matches `Bearer <token>` authorization values.
+	BearerTokenPattern = regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._~+/-]+=*`)
+
+	// JWTPattern matches JSON Web Tokens.
+	JWTPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+	// CreditCardPattern matches 13 to 19 digits numbers, optionally separated by spaces or
+	// dashes. Prefer `RedactCreditCardNumbers` which also validates the Luhn checksum.
+	CreditCardPattern = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+
+	// IPv4Pattern matches IPv4 addresses.
+	IPv4Pattern = regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`)
+)
+
+// RedactionRule matches either attributes by key or data by value, see `RedactKey`
+// and `RedactValue`.
+type RedactionRule struct {
+	keyPattern   *regexp.Regexp
+	valuePattern *regexp.Regexp
+	validate     func(match string) bool
+	action       RedactionAction
+}
+
+// RedactKey returns a rule redacting the whole value of attributes whose key matches
+// the case-insensitive glob `pattern` (`*token*` or `authorization` for example).
+func RedactKey(pattern string, action RedactionAction) RedactionRule {
+	return RedactionRule{keyPattern: compileGlob(strings.ToLower(pattern)), action: action}
+}
+
+// RedactValue returns a rule redacting the parts of string attribute values and
+// annotation messages matching `pattern`. With `RedactionDrop`, attributes having a
+// matching value are removed entirely.
+func RedactValue(pattern *regexp.Regexp, action RedactionAction) RedactionRule {
+	return RedactionRule{valuePattern: pattern, action: action}
+}
+
+// RedactCreditCardNumbers returns a rule redacting the values matching `CreditCardPattern`
+// that have a valid Luhn checksum.
+func RedactCreditCardNumbers(action RedactionAction) RedactionRule {
+	return RedactionRule{valuePattern: CreditCardPattern, validate: isLuhnValid, action: action}
+}
+
+// DefaultRedactionRules returns rules applying `action` to the attributes whose key
+// looks like a credential (`*token*`, `*password*`, `*secret*`, `authorization`,
+// `*api_key*`, `*apikey*` and `*cookie*`) and to email addresses, bearer tokens, JSON
+// Web Tokens and credit card numbers found in values.
+func DefaultRedactionRules(action RedactionAction) []RedactionRule {
+	return []RedactionRule{
+		RedactKey("*token*", action),
+		RedactKey("*password*", action),
+		RedactKey("*secret*", action),
+		RedactKey("authorization", action),
+		RedactKey("*api_key*", action),
+		RedactKey("*apikey*", action),
+		RedactKey("*cookie*", action),
+		RedactValue(EmailPattern, action),
+		RedactValue(BearerTokenPattern, action),
+		RedactValue(JWTPattern, action),
+		RedactCreditCardNumbers(action),
+	}
+}
+
+// Redactor applies redaction rules to span attributes, annotation attributes and
+// annotation messages.
+type Redactor struct {
+	keyRules   []RedactionRule
+	valueRules []RedactionRule
+	hashKey    []byte
+}
+
+// NewRedactor returns a redactor applying `rules`. Key rules are checked first, in
+// order, the first matching one being applied to the whole value. Value rules are then
+// all applied, in order, to string values.
+func NewRedactor(rules ...RedactionRule) *Redactor {
+	redactor := &Redactor{}
+	for _, rule := range rules {
+		if rule.keyPattern != nil {
+			redactor.keyRules = append(redactor.keyRules, rule)
+		} else if rule.valuePattern != nil {
+			redactor.valueRules = append(redactor.valueRules, rule)
+		}
+	}
+
+	return redactor
+}
+
+// WithHashKey sets the secret key of the HMAC used by `RedactionHash` rules and returns
+// the redactor, it must be called before the redactor is used. The key should be random,
+// kept secret and shared by the services whose hashed values must be correlated.
+func (r *Redactor) WithHashKey(key []byte) *Redactor {
+	r.hashKey = key
+	return r
+}
+
+// RedactSpan returns a copy of `span` with its attributes, annotation attributes,
+// annotation messages and status message redacted. Dropped attributes are accounted
+// in `DroppedAttributeCount`.
+func (r *Redactor) RedactSpan(span *trace.SpanData) *trace.SpanData {
+	redacted := *span
+
+	var dropped int
+	redacted.Attributes, dropped = r.RedactAttributes(span.Attributes)
+	redacted.DroppedAttributeCount += dropped
+
+	if len(span.Annotations) > 0 {
+		redacted.Annotations = make([]trace.Annotation, len(span.Annotations))
+		for i, annotation := range span.Annotations {
+			redacted.Annotations[i] = annotation
+			redacted.Annotations[i].Message, _ = r.redactString(annotation.Message, false)
+			redacted.Annotations[i].Attributes, _ = r.RedactAttributes(annotation.Attributes)
+		}
+	}
+
+	redacted.Status.Message, _ = r.redactString(span.Status.Message, false)
+
+	return &redacted
+}
+
+// RedactAttributes returns a redacted copy of `attributes` along with the number of
+// dropped attributes.
+func (r *Redactor) RedactAttributes(attributes map[string]interface{}) (out map[string]interface{}, dropped int) {
+	if attributes == nil {
+		return nil, 0
+	}
+
+	out = make(map[string]interface{}, len(attributes))
+	for key, value := range attributes {
+		if redactedValue, keep := r.redactValue(key, value); keep {
+			out[key] = redactedValue
+		} else {
+			dropped++
+		}
+	}
+
+	return out, dropped
+}
+
+// RedactTraceAttributes returns a redacted copy of `attributes`, dropped attributes are
+// omitted. Masked or hashed non-string values become string attributes.
+func (r *Redactor) RedactTraceAttributes(attributes []trace.Attribute) []trace.Attribute {
+	out := make([]trace.Attribute, 0, len(attributes))
+	for _, attribute := range attributes {
+		value, keep := r.redactValue(attribute.Key(), attribute.Value())
+		if !keep {
+			continue
+		}
+
+		switch v := value.(type) {
+		case string:
+			out = append(out, trace.StringAttribute(attribute.Key(), v))
+		case int64:
+			out = append(out, trace.Int64Attribute(attribute.Key(), v))
+		case float64:
+			out = append(out, trace.Float64Attribute(attribute.Key(), v))
+		case bool:
+			out = append(out, trace.BoolAttribute(attribute.Key(), v))
+		default:
+			out = append(out, attribute)
+		}
+	}
+
+	return out
+}
+
+func (r *Redactor) redactValue(key string, value interface{}) (interface{}, bool) {
+	lowerKey := strings.ToLower(key)
+	for _, rule := range r.keyRules {
+		if rule.keyPattern.MatchString(lowerKey) {
+			switch rule.action {
+			case RedactionDrop:
+				return nil, false
+			case RedactionHash:
+				return r.hash(fmt.Sprintf("%v", value)), true
+			default:
+				return RedactedValue, true
+			}
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return r.redactString(s, true)
+	}
+
+	return value, true
+}
+
+// redactString applies the value rules to `s`. When `dropWhole` is true, a match of a
+// `RedactionDrop` rule drops the whole value, otherwise only the matched text is removed.
+func (r *Redactor) redactString(s string, dropWhole bool) (string, bool) {
+	for _, rule := range r.valueRules {
+		dropped := false
+		s = rule.valuePattern.ReplaceAllStringFunc(s, func(match string) string {
+			if rule.validate != nil && !rule.validate(match) {
+				return match
+			}
+
+			switch rule.action {
+			case RedactionDrop:
+				dropped = true
+				return ""
+			case RedactionHash:
+				return r.hash(match)
+			default:
+				return RedactedValue
+			}
+		})
+
+		if dropped && dropWhole {
+			return "", false
+		}
+	}
+
+	return s, true
+}
+
+func (r *Redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(value))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// isLuhnValid checks the Luhn checksum of the digits found in `value`.
+func isLuhnValid(value string) bool {
+	sum, count := 0, 0
+	for i := len(value) - 1; i >= 0; i-- {
+		char := value[i]
+		if char < '0' || char > '9' {
+			continue
+		}
+
+		digit := int(char - '0')
+		if count%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+
+		sum += digit
+		count++
+	}
+
+	return count > 0 && sum%10 == 0
+}
+
+// RedactingExporter is a `trace.Exporter` redacting spans (see `Redactor.RedactSpan`)
+// before passing them to the wrapped exporter.
+type RedactingExporter struct {
+	inner    trace.Exporter
+	redactor *Redactor
+}
+
+// Compile time assertion that the exporter implements trace.Exporter
+var _ trace.Exporter = (*RedactingExporter)(nil)
+
+// NewRedactingExporter returns an exporter redacting spans with `redactor` before
+// exporting them to `inner`. Flushing and closing the exporter flushes and closes
+// `inner` if it has a `Flush()` or `Close() error` method.
+func NewRedactingExporter(inner trace.Exporter, redactor *Redactor) *RedactingExporter {
+	return &RedactingExporter{inner: inner, redactor: redactor}
+}
+
+func (e *RedactingExporter) ExportSpan(span *trace.SpanData) {
+	e.inner.ExportSpan(e.redactor.RedactSpan(span))
+}
+
+func (e *RedactingExporter) Flush() {
+	if f, ok := e.inner.(flusher); ok {
+		f.Flush()
+	}
+}
+
+func (e *RedactingExporter) Close() error {
+	if c, ok := e.inner.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+var spanRedactor atomic.Value // *Redactor
+
+func init() {
+	spanRedactor.Store((*Redactor)(nil))
+}
+
+// SetSpanRedactor sets the redactor applied to the attributes passed to `StartSpan`
+// (and friends) before they are added to the span, so that sensitive values never
+// reach any exporter. Passing nil disables redaction, which is the default.
+//
+// Attributes and annotations added directly on the `trace.Span` are not redacted, wrap
+// the exporters with `NewRedactingExporter` to cover them.
+func SetSpanRedactor(redactor *Redactor) {
+	spanRedactor.Store(redactor)
+}
+
+func redactStartAttributes(attributes []trace.Attribute) []trace.Attribute {
+	redactor := spanRedactor.Load().(*Redactor)
+	if redactor == nil || len(attributes) == 0 {
+		return attributes
+	}
+
+	return redactor.RedactTraceAttributes(attributes)
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+)
+
+func TestRedactor_RedactSpan(t *testing.T) {
+	tests := []struct {
+		name               string
+		rules              []RedactionRule
+		attributes         map[string]interface{}
+		expectedAttributes map[string]interface{}
+	}{
+		{
+			"key mask",
+			[]RedactionRule{RedactKey("*token*", RedactionMask)},
+			map[string]interface{}{"Access_Token": "abc", "retries": int64(1)},
+			map[string]interface{}{"Access_Token": "[REDACTED]", "retries": int64(1)},
+		},
+		{
+			"key hash non string",
+			[]RedactionRule{RedactKey("user.id", RedactionHash)},
+			map[string]interface{}{"user.id": int64(42)},
+			map[string]interface{}{"user.id": "hmac-sha256:96ce0a5a8208370a"},
+		},
+		{
+			"key drop",
+			[]RedactionRule{RedactKey("authorization", RedactionDrop)},
+			map[string]interface{}{"authorization": "Basic abc", "method": "GET"},
+			map[string]interface{}{"method": "GET"},
+		},
+		{
+			"value mask",
+			[]RedactionRule{RedactValue(EmailPattern, RedactionMask)},
+			map[string]interface{}{"query": "user=john@example.com&page=1"},
+			map[string]interface{}{"query": "user=[REDACTED]&page=1"},
+		},
+		{
+			"value drop",
+			[]RedactionRule{RedactValue(BearerTokenPattern, RedactionDrop)},
+			map[string]interface{}{"header": "Bearer abc.def", "other": "bearing"},
+			map[string]interface{}{"other": "bearing"},
+		},
+		{
+			"credit card luhn",
+			[]RedactionRule{RedactCreditCardNumbers(RedactionMask)},
+			map[string]interface{}{"valid": "card 4111 1111 1111 1111", "invalid": "order 1234567890123"},
+			map[string]interface{}{"valid": "card [REDACTED]", "invalid": "order 1234567890123"},
+		},
+		{
+			"defaults",
+			DefaultRedactionRules(RedactionMask),
+			map[string]interface{}{"jwt": "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig", "api_key": "k", "ip": "10.0.0.1"},
+			map[string]interface{}{"jwt": "[REDACTED]", "api_key": "[REDACTED]", "ip": "10.0.0.1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			span := &trace.SpanData{Name: "span", Attributes: test.attributes}
+			redacted := NewRedactor(test.rules...).RedactSpan(span)
+
+			assert.Equal(t, test.expectedAttributes, redacted.Attributes)
+			assert.Equal(t, len(test.attributes)-len(test.expectedAttributes), redacted.DroppedAttributeCount)
+		})
+	}
+}
+
+func TestRedactor_WithHashKey(t *testing.T) {
+	span := &trace.SpanData{Name: "span", Attributes: map[string]interface{}{"user.id": int64(42)}}
+	redacted := NewRedactor(RedactKey("user.id", RedactionHash)).WithHashKey([]byte("key")).RedactSpan(span)
+
+	assert.Equal(t, map[string]interface{}{"user.id": "hmac-sha256:f2991b7ce981d0b5"}, redacted.Attributes)
+}
+
+func TestRedactingExporter(t *testing.T) {
+	inner := &capturingExporter{}
+	redactor := NewRedactor(RedactKey("*secret*", RedactionDrop), RedactValue(EmailPattern, RedactionHash)).WithHashKey([]byte("key"))
+	exporter := NewRedactingExporter(inner, redactor)
+
+	original := &trace.SpanData{
+		Name:       "span",
+		Attributes: map[string]interface{}{"client_secret": "s3cr3t"},
+		Annotations: []trace.Annotation{
+			{Message: "sent to john@example.com", Attributes: map[string]interface{}{"to": "john@example.com", "secret": "s3cr3t"}},
+		},
+		Status: trace.Status{Code: trace.StatusCodeNotFound, Message: "user john@example.com not found"},
+	}
+	exporter.ExportSpan(original)
+
+	require.Len(t, inner.spans, 1)
+	span := inner.spans[0]
+
+	hashed := redactor.hash("john@example.com")
+	assert.Equal(t, map[string]interface{}{}, span.Attributes)
+	assert.Equal(t, 1, span.DroppedAttributeCount)
+	assert.Equal(t, "sent to "+hashed, span.Annotations[0].Message)
+	assert.Equal(t, map[string]interface{}{"to": hashed}, span.Annotations[0].Attributes)
+	assert.Equal(t, "user "+hashed+" not found", span.Status.Message)
+
+	assert.Equal(t, "s3cr3t", original.Attributes["client_secret"], "original span must not be modified")
+	assert.Equal(t, "sent to john@example.com", original.Annotations[0].Message, "original span must not be modified")
+}
+
+func TestSetSpanRedactor(t *testing.T) {
+	SetSpanRedactor(NewRedactor(DefaultRedactionRules(RedactionMask)...))
+	defer SetSpanRedactor(nil)
+
+	exporter := &capturingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	_, span := StartSpanWithSampler(context.Background(), "span", trace.AlwaysSample(), "password", "hunter2", "email", "john@example.com", "count", 2)
+	span.End()
+
+	require.Len(t, exporter.spans, 1)
+	assert.Equal(t, map[string]interface{}{"password": "[REDACTED]", "email": "[REDACTED]", "count": int64(2)}, exporter.spans[0].Attributes)
+}
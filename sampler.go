@@ -0,0 +1,187 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// samplerHolder wraps the default sampler since `atomic.Value` requires all stored values
+// to be of the same concrete type.
+type samplerHolder struct {
+	sampler trace.Sampler
+}
+
+var defaultSampler atomic.Value // access atomically
+
+func init() {
+	// OpenCensus own default sampler
+	defaultSampler.Store(samplerHolder{trace.ProbabilitySampler(1e-4)})
+}
+
+// SetDefaultSampler sets the OpenCensus default sampler and returns the previous one so
+// that it can be restored later, a nil `sampler` leaves the default sampler untouched.
+//
+// OpenCensus offers no way to read its default sampler, the previous sampler is thus the
+// one last set through dtracing (`SetDefaultSampler`, `SetupTracing`, `Register*`
+// functions, ...) or OpenCensus own default one. Prefer this function over
+// `trace.ApplyConfig` to change the default sampler.
+func SetDefaultSampler(sampler trace.Sampler) (previous trace.Sampler) {
+	if sampler == nil {
+		return getDefaultSampler()
+	}
+
+	previous = getDefaultSampler()
+	defaultSampler.Store(samplerHolder{sampler})
+	trace.ApplyConfig(trace.Config{DefaultSampler: sampler})
+
+	return previous
+}
+
+func getDefaultSampler() trace.Sampler {
+	return defaultSampler.Load().(samplerHolder).sampler
+}
+
+// maxGuaranteedSpanNames bounds the number of per span name token buckets kept by
+// `GuaranteedThroughputSampler`, spans with other names only use the fallback.
+const maxGuaranteedSpanNames = 10000
+
+// RateLimitingSampler returns a sampler sampling at most `tracesPerSecond` traces per
+// second, with bursts of up to `max(1, tracesPerSecond)` traces. Spans whose parent is
+// sampled are always sampled so that traces are never cut in the middle.
+//
+// The sampler is lock-free and safe to use from many goroutines concurrently. It can be
+// used as the default sampler (see `WithSampler`) or for specific spans through
+// `StartSpanWithSampler`.
+func RateLimitingSampler(tracesPerSecond float64) trace.Sampler {
+	bucket := newTokenBucket(tracesPerSecond, monotonicNow)
+
+	return func(params trace.SamplingParameters) trace.SamplingDecision {
+		if params.ParentContext.IsSampled() {
+			return trace.SamplingDecision{Sample: true}
+		}
+
+		return trace.SamplingDecision{Sample: bucket.take()}
+	}
+}
+
+// GuaranteedThroughputSampler returns a sampler sampling at least `minTracesPerSecond`
+// traces per second for each span name, spans above that rate being sampled with the
+// given `probability`. This ensures that rare code paths are always traced while
+// frequent ones are sampled proportionally. Spans whose parent is sampled are always
+// sampled.
+//
+// Like `RateLimitingSampler`, the sampler is lock-free once a span name has been seen.
+func GuaranteedThroughputSampler(minTracesPerSecond float64, probability float64) trace.Sampler {
+	fallback := trace.ProbabilitySampler(probability)
+
+	var buckets sync.Map
+	var bucketCount int64
+
+	return func(params trace.SamplingParameters) trace.SamplingDecision {
+		if params.ParentContext.IsSampled() {
+			return trace.SamplingDecision{Sample: true}
+		}
+
+		value, found := buckets.Load(params.Name)
+		if !found && atomic.LoadInt64(&bucketCount) < maxGuaranteedSpanNames {
+			var loaded bool
+			value, loaded = buckets.LoadOrStore(params.Name, newTokenBucket(minTracesPerSecond, monotonicNow))
+			if !loaded {
+				atomic.AddInt64(&bucketCount, 1)
+			}
+
+			found = true
+		}
+
+		if found && value.(*tokenBucket).take() {
+			return trace.SamplingDecision{Sample: true}
+		}
+
+		return fallback(params)
+	}
+}
+
+var monotonicStart = time.Now()
+
+func monotonicNow() int64 {
+	return int64(time.Since(monotonicStart))
+}
+
+// tokenBucket is a lock-free token bucket implemented as a generic cell rate algorithm:
+// instead of counting tokens, it tracks the theoretical arrival time of the next token,
+// which fits in a single atomically updated integer.
+type tokenBucket struct {
+	// interval is the time, in nanoseconds, to earn one token
+	interval int64
+	// burst is the time, in nanoseconds, to fill the bucket
+	burst int64
+	now   func() int64
+
+	theoreticalArrival int64 // access atomically
+}
+
+func newTokenBucket(tokensPerSecond float64, now func() int64) *tokenBucket {
+	if tokensPerSecond <= 0 {
+		return &tokenBucket{interval: -1, now: now}
+	}
+
+	interval := int64(float64(time.Second) / tokensPerSecond)
+	if interval < 1 {
+		interval = 1
+	}
+
+	bucket := &tokenBucket{
+		interval: interval,
+		burst:    interval * int64(math.Max(1, math.Floor(tokensPerSecond))),
+		now:      now,
+	}
+
+	// The bucket starts full
+	bucket.theoreticalArrival = now() - bucket.burst
+
+	return bucket
+}
+
+func (b *tokenBucket) take() bool {
+	if b.interval < 0 {
+		return false
+	}
+
+	now := b.now()
+	for {
+		arrival := atomic.LoadInt64(&b.theoreticalArrival)
+
+		// Tokens earned while idle are capped to the bucket's burst
+		next := arrival
+		if next < now-b.burst {
+			next = now - b.burst
+		}
+		next += b.interval
+
+		if next > now {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(&b.theoreticalArrival, arrival, next) {
+			return true
+		}
+	}
+}
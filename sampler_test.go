@@ -0,0 +1,91 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := int64(0)
+	bucket := newTokenBucket(2, func() int64 { return now })
+
+	assert.True(t, bucket.take())
+	assert.True(t, bucket.take())
+	assert.False(t, bucket.take(), "burst of 2 exhausted")
+
+	now += int64(250 * time.Millisecond)
+	assert.False(t, bucket.take())
+
+	now += int64(250 * time.Millisecond)
+	assert.True(t, bucket.take())
+	assert.False(t, bucket.take())
+
+	now += int64(10 * time.Second)
+	assert.True(t, bucket.take())
+	assert.True(t, bucket.take())
+	assert.False(t, bucket.take(), "bucket is capped to its burst")
+
+	assert.False(t, newTokenBucket(0, func() int64 { return now }).take())
+}
+
+func TestTokenBucket_Concurrent(t *testing.T) {
+	now := int64(0)
+	bucket := newTokenBucket(100, func() int64 { return now })
+
+	var taken int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if bucket.take() {
+					atomic.AddInt64(&taken, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(100), taken)
+}
+
+func TestRateLimitingSampler(t *testing.T) {
+	sampler := RateLimitingSampler(1)
+
+	assert.True(t, sampler(trace.SamplingParameters{Name: "root"}).Sample)
+	assert.False(t, sampler(trace.SamplingParameters{Name: "root"}).Sample)
+
+	sampledParent := trace.SamplingParameters{Name: "child", ParentContext: trace.SpanContext{TraceOptions: 1}}
+	assert.True(t, sampler(sampledParent).Sample, "sampled parent is honored")
+}
+
+func TestGuaranteedThroughputSampler(t *testing.T) {
+	sampler := GuaranteedThroughputSampler(1, 0)
+
+	assert.True(t, sampler(trace.SamplingParameters{Name: "frequent"}).Sample)
+	assert.False(t, sampler(trace.SamplingParameters{Name: "frequent"}).Sample)
+	assert.True(t, sampler(trace.SamplingParameters{Name: "rare"}).Sample, "each name has its own guaranteed throughput")
+
+	sampler = GuaranteedThroughputSampler(0, 1)
+	assert.True(t, sampler(trace.SamplingParameters{Name: "frequent"}).Sample, "probabilistic fallback")
+}
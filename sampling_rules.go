@@ -0,0 +1,277 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sync/atomic"
+
+	"go.opencensus.io/trace"
+	"gopkg.in/yaml.v2"
+)
+
+// SamplingRule samples the spans it matches with probability `Rate`. A rule matches a
+// span when its name matches `Name` (a glob, see `FilterSpanName`) or `NameRegex`, and
+// all of `Attributes` match, attribute values being globs matched against the `%v`
+// representation of the span's attribute value. Empty criteria match all spans.
+type SamplingRule struct {
+	Name       string            `json:"name,omitempty" yaml:"name,omitempty"`
+	NameRegex  string            `json:"name_regex,omitempty" yaml:"name_regex,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+	Rate       float64           `json:"rate" yaml:"rate"`
+}
+
+type compiledSamplingRule struct {
+	name       *regexp.Regexp
+	attributes map[string]*regexp.Regexp
+	sampler    trace.Sampler
+}
+
+func (r *compiledSamplingRule) matches(name string, attributes []trace.Attribute) bool {
+	if r.name != nil && !r.name.MatchString(name) {
+		return false
+	}
+
+	for key, pattern := range r.attributes {
+		found := false
+		for _, attribute := range attributes {
+			if attribute.Key() == key && pattern.MatchString(fmt.Sprintf("%v", attribute.Value())) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SamplingRules is a rule-based sampler, the first rule matching a span decides if it's
+// sampled, the fallback sampler being used when no rule matches. Spans whose parent is
+// sampled are always sampled.
+type SamplingRules struct {
+	rules             []*compiledSamplingRule
+	fallback          trace.Sampler
+	hasAttributeRules bool
+}
+
+// NewSamplingRules validates and compiles `rules`, `fallback` is used for spans matched
+// by no rule and defaults to `trace.ProbabilitySampler(1/4.0)` when nil.
+func NewSamplingRules(rules []SamplingRule, fallback trace.Sampler) (*SamplingRules, error) {
+	if fallback == nil {
+		fallback = trace.ProbabilitySampler(1 / 4.0)
+	}
+
+	samplingRules := &SamplingRules{fallback: fallback}
+	for i, rule := range rules {
+		if rule.Rate < 0 || rule.Rate > 1 {
+			return nil, fmt.Errorf("sampling rule %d: rate must be between 0 and 1, got %v", i, rule.Rate)
+		}
+
+		if rule.Name != "" && rule.NameRegex != "" {
+			return nil, fmt.Errorf("sampling rule %d: only one of name and name_regex can be specified", i)
+		}
+
+		compiled := &compiledSamplingRule{sampler: trace.ProbabilitySampler(rule.Rate)}
+		if rule.Name != "" {
+			compiled.name = compileGlob(rule.Name)
+		}
+
+		if rule.NameRegex != "" {
+			var err error
+			if compiled.name, err = regexp.Compile(rule.NameRegex); err != nil {
+				return nil, fmt.Errorf("sampling rule %d: invalid name_regex: %s", i, err)
+			}
+		}
+
+		if len(rule.Attributes) > 0 {
+			compiled.attributes = make(map[string]*regexp.Regexp, len(rule.Attributes))
+			for key, value := range rule.Attributes {
+				compiled.attributes[key] = compileGlob(value)
+			}
+
+			samplingRules.hasAttributeRules = true
+		}
+
+		samplingRules.rules = append(samplingRules.rules, compiled)
+	}
+
+	return samplingRules, nil
+}
+
+// ParseSamplingRules parses a list of rules in JSON or YAML format, for example:
+//
+//	# Sample all admin requests, no health checks and 1% of live firehose streams
+//	- name: /admin/*
+//	  rate: 1
+//	- name_regex: ^/health(z)?$
+//	  rate: 0
+//	- name: firehose.*
+//	  attributes:
+//	    stream.type: live
+//	  rate: 0.01
+//
+// Unknown keys are rejected and `rate` is required, so that a typo does not silently
+// stop sampling the matched spans.
+func ParseSamplingRules(data []byte) ([]SamplingRule, error) {
+	var documents []samplingRuleDocument
+	var err error
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&documents)
+	} else {
+		err = yaml.UnmarshalStrict(trimmed, &documents)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid sampling rules: %s", err)
+	}
+
+	rules := make([]SamplingRule, len(documents))
+	for i, document := range documents {
+		if document.Rate == nil {
+			return nil, fmt.Errorf("invalid sampling rules: rule %d: rate is required", i)
+		}
+
+		rules[i] = SamplingRule{
+			Name:       document.Name,
+			NameRegex:  document.NameRegex,
+			Attributes: document.Attributes,
+			Rate:       *document.Rate,
+		}
+	}
+
+	return rules, nil
+}
+
+// samplingRuleDocument is the parsed form of a `SamplingRule`, telling apart a missing
+// `rate` from a zero one.
+type samplingRuleDocument struct {
+	Name       string            `json:"name" yaml:"name"`
+	NameRegex  string            `json:"name_regex" yaml:"name_regex"`
+	Attributes map[string]string `json:"attributes" yaml:"attributes"`
+	Rate       *float64          `json:"rate" yaml:"rate"`
+}
+
+// LoadSamplingRulesFile reads and parses the JSON or YAML rules file at `path`, see
+// `ParseSamplingRules`.
+func LoadSamplingRulesFile(path string) ([]SamplingRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sampling rules file: %s", err)
+	}
+
+	return ParseSamplingRules(data)
+}
+
+// SamplingRulesFromEnv returns the rules defined inline in the `TRACING_SAMPLING_RULES`
+// environment variable or in the file pointed by `TRACING_SAMPLING_RULES_FILE`, see
+// `ParseSamplingRules`. Nil rules are returned when neither variable is set.
+func SamplingRulesFromEnv(fallback trace.Sampler) (*SamplingRules, error) {
+	var rules []SamplingRule
+	var err error
+
+	if inline := os.Getenv("TRACING_SAMPLING_RULES"); inline != "" {
+		rules, err = ParseSamplingRules([]byte(inline))
+	} else if path := os.Getenv("TRACING_SAMPLING_RULES_FILE"); path != "" {
+		rules, err = LoadSamplingRulesFile(path)
+	} else {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSamplingRules(rules, fallback)
+}
+
+// Sampler returns a sampler applying the rules. OpenCensus samplers only see the span
+// name, rules with attribute matchers are thus skipped, see `SetDefaultSamplingRules`
+// to also apply them.
+func (r *SamplingRules) Sampler() trace.Sampler {
+	return r.samplerWithAttributes(nil, false)
+}
+
+func (r *SamplingRules) samplerWithAttributes(attributes []trace.Attribute, withAttributes bool) trace.Sampler {
+	return func(params trace.SamplingParameters) trace.SamplingDecision {
+		if params.ParentContext.IsSampled() {
+			return trace.SamplingDecision{Sample: true}
+		}
+
+		for _, rule := range r.rules {
+			if len(rule.attributes) > 0 && !withAttributes {
+				continue
+			}
+
+			if rule.matches(params.Name, attributes) {
+				return rule.sampler(params)
+			}
+		}
+
+		return r.fallback(params)
+	}
+}
+
+var defaultSamplingRules atomic.Value // *SamplingRules
+
+func init() {
+	defaultSamplingRules.Store((*SamplingRules)(nil))
+}
+
+// SetDefaultSamplingRules sets `rules` as the OpenCensus default sampler. Root spans
+// started through `StartSpan` (and friends) without an explicit sampler are also matched
+// against the rules having attribute matchers, using the attributes given at start.
+// Passing nil stops applying attribute rules, the default sampler is left untouched.
+func SetDefaultSamplingRules(rules *SamplingRules) {
+	defaultSamplingRules.Store(rules)
+
+	if rules != nil {
+		SetDefaultSampler(rules.Sampler())
+	}
+}
+
+// clearDefaultSamplingRules stops applying `rules` if they are still the default ones.
+func clearDefaultSamplingRules(rules *SamplingRules) {
+	if defaultSamplingRules.Load().(*SamplingRules) == rules {
+		defaultSamplingRules.Store((*SamplingRules)(nil))
+	}
+}
+
+// startSampler returns the sampler to use for a root span started with `attributes`,
+// `sampler` when explicitly provided.
+func startSampler(sampler trace.Sampler, attributes []trace.Attribute) trace.Sampler {
+	if sampler != nil {
+		return sampler
+	}
+
+	rules := defaultSamplingRules.Load().(*SamplingRules)
+	if rules == nil || !rules.hasAttributeRules {
+		return nil
+	}
+
+	return rules.samplerWithAttributes(attributes, true)
+}
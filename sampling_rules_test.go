@@ -0,0 +1,145 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+)
+
+const testSamplingRulesYAML = `
+- name: /admin/*
+  rate: 1
+- name_regex: ^/health(z)?$
+  rate: 0
+- name: firehose.*
+  attributes:
+    stream.type: live
+  rate: 0
+`
+
+func TestParseSamplingRules(t *testing.T) {
+	expected := []SamplingRule{
+		{Name: "/admin/*", Rate: 1},
+		{NameRegex: "^/health(z)?$", Rate: 0},
+		{Name: "firehose.*", Attributes: map[string]string{"stream.type": "live"}, Rate: 0},
+	}
+
+	rules, err := ParseSamplingRules([]byte(testSamplingRulesYAML))
+	require.NoError(t, err)
+	assert.Equal(t, expected, rules)
+
+	rules, err = ParseSamplingRules([]byte(`[{"name": "/admin/*", "rate": 1}, {"name_regex": "^/health(z)?$", "rate": 0}, {"name": "firehose.*", "attributes": {"stream.type": "live"}, "rate": 0}]`))
+	require.NoError(t, err)
+	assert.Equal(t, expected, rules)
+
+	_, err = ParseSamplingRules([]byte("- nam: typo\n  rate: 1"))
+	assert.Error(t, err)
+
+	_, err = ParseSamplingRules([]byte(`[{"name": "/admin/*", "rates": 1}]`))
+	assert.EqualError(t, err, `invalid sampling rules: json: unknown field "rates"`)
+
+	_, err = ParseSamplingRules([]byte("- name: /admin/*"))
+	assert.EqualError(t, err, "invalid sampling rules: rule 0: rate is required")
+
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testSamplingRulesYAML), 0644))
+
+	os.Setenv("TRACING_SAMPLING_RULES_FILE", path)
+	defer os.Unsetenv("TRACING_SAMPLING_RULES_FILE")
+
+	samplingRules, err := SamplingRulesFromEnv(nil)
+	require.NoError(t, err)
+	assert.Len(t, samplingRules.rules, 3)
+
+	os.Setenv("TRACING_SAMPLING_RULES", `[{"name": "a", "rate": 2}]`)
+	defer os.Unsetenv("TRACING_SAMPLING_RULES")
+
+	_, err = SamplingRulesFromEnv(nil)
+	assert.EqualError(t, err, "sampling rule 0: rate must be between 0 and 1, got 2")
+}
+
+func TestSamplingRules_Sampler(t *testing.T) {
+	rules, err := ParseSamplingRules([]byte(testSamplingRulesYAML))
+	require.NoError(t, err)
+
+	samplingRules, err := NewSamplingRules(rules, trace.AlwaysSample())
+	require.NoError(t, err)
+	sampler := samplingRules.Sampler()
+
+	tests := []struct {
+		name          string
+		parent        trace.SpanContext
+		expectedValue bool
+	}{
+		{"/admin/users", trace.SpanContext{}, true},
+		{"/healthz", trace.SpanContext{}, false},
+		{"/health", trace.SpanContext{TraceOptions: 1}, true},
+		{"/healthcheck", trace.SpanContext{}, true},
+		{"firehose.Stream/Blocks", trace.SpanContext{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expectedValue, sampler(trace.SamplingParameters{Name: test.name, ParentContext: test.parent}).Sample)
+		})
+	}
+
+	_, err = NewSamplingRules([]SamplingRule{{Name: "a", NameRegex: "b"}}, nil)
+	assert.EqualError(t, err, "sampling rule 0: only one of name and name_regex can be specified")
+
+	_, err = NewSamplingRules([]SamplingRule{{NameRegex: "("}}, nil)
+	assert.EqualError(t, err, "sampling rule 0: invalid name_regex: error parsing regexp: missing closing ): `(`")
+}
+
+func TestSetDefaultSamplingRules(t *testing.T) {
+	rules, err := ParseSamplingRules([]byte(testSamplingRulesYAML))
+	require.NoError(t, err)
+
+	samplingRules, err := NewSamplingRules(rules, trace.AlwaysSample())
+	require.NoError(t, err)
+
+	previousSampler := getDefaultSampler()
+	SetDefaultSamplingRules(samplingRules)
+	defer func() {
+		SetDefaultSamplingRules(nil)
+		SetDefaultSampler(previousSampler)
+	}()
+
+	_, span := StartSpan(context.Background(), "firehose.Stream/Blocks", "stream.type", "live")
+	assert.False(t, span.SpanContext().IsSampled(), "attribute rule applies")
+	span.End()
+
+	_, span = StartFreshSpan(context.Background(), "firehose.Stream/Blocks", "stream.type", "historical")
+	assert.True(t, span.SpanContext().IsSampled(), "attribute rule does not match")
+	span.End()
+
+	_, span = StartSpan(context.Background(), "/healthz")
+	assert.False(t, span.SpanContext().IsSampled(), "default sampler is rules sampler")
+	span.End()
+
+	ctx, parent := StartSpan(context.Background(), "/admin/users")
+	_, span = StartSpan(ctx, "firehose.Stream/Blocks", "stream.type", "live")
+	assert.True(t, span.SpanContext().IsSampled(), "child spans follow their parent")
+	span.End()
+	parent.End()
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"go.opencensus.io/trace"
+	"go.uber.org/multierr"
+)
+
+// ShutdownFunc flushes and unregisters every exporter that was installed by
+// the call that returned it. It returns as soon as all exporters are flushed
+// or when `ctx` is done, whichever comes first, in which case the context
+// error is returned.
+//
+// Calling a ShutdownFunc more than once is safe, only the first call does
+// actual work.
+type ShutdownFunc func(ctx context.Context) error
+
+// NoopShutdown is a ShutdownFunc that does nothing, useful as a default value
+// when tracing is not configured.
+func NoopShutdown(ctx context.Context) error {
+	return nil
+}
+
+type flusher interface {
+	Flush()
+}
+
+// registerExporter registers `exporter` globally and returns a ShutdownFunc that
+// unregisters it, flushes it if it has a `Flush()` method and finally closes it if
+// it's an `io.Closer`.
+func registerExporter(exporter trace.Exporter) ShutdownFunc {
+	trace.RegisterExporter(exporter)
+
+	return newShutdownFunc(func() error {
+		trace.UnregisterExporter(exporter)
+
+		if f, ok := exporter.(flusher); ok {
+			f.Flush()
+		}
+
+		if c, ok := exporter.(io.Closer); ok {
+			return c.Close()
+		}
+
+		return nil
+	})
+}
+
+// newShutdownFunc wraps `shutdown` so that it's executed only once and
+// so that the caller's context deadline is honored.
+func newShutdownFunc(shutdown func() error) ShutdownFunc {
+	var once sync.Once
+	done := make(chan struct{})
+	var shutdownErr error
+
+	return func(ctx context.Context) error {
+		once.Do(func() {
+			go func() {
+				defer close(done)
+				shutdownErr = shutdown()
+			}()
+		})
+
+		select {
+		case <-done:
+			return shutdownErr
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// joinShutdowns returns a ShutdownFunc that invokes all `shutdowns` in reverse
+// order of registration, collecting all errors.
+func joinShutdowns(shutdowns ...ShutdownFunc) ShutdownFunc {
+	return func(ctx context.Context) (err error) {
+		for i := len(shutdowns) - 1; i >= 0; i-- {
+			if shutdowns[i] == nil {
+				continue
+			}
+
+			err = multierr.Append(err, shutdowns[i](ctx))
+		}
+
+		return err
+	}
+}
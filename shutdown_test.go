@@ -0,0 +1,144 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+)
+
+// lifecycleLog records the calls made on `lifecycleExporter` instances.
+type lifecycleLog struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (l *lifecycleLog) record(event string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.events = append(l.events, event)
+}
+
+func (l *lifecycleLog) all() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return append([]string(nil), l.events...)
+}
+
+type lifecycleExporter struct {
+	capturingExporter
+
+	name     string
+	log      *lifecycleLog
+	closeErr error
+	release  chan struct{}
+}
+
+func (e *lifecycleExporter) Flush() {
+	e.log.record("flush " + e.name)
+}
+
+func (e *lifecycleExporter) Close() error {
+	if e.release != nil {
+		<-e.release
+	}
+
+	e.log.record("close " + e.name)
+	return e.closeErr
+}
+
+func TestShutdownFunc(t *testing.T) {
+	tests := []struct {
+		name           string
+		closeErr       error
+		calls          int
+		expectedEvents []string
+		expectedErr    string
+	}{
+		{
+			"flushes before closing in reverse order",
+			nil,
+			1,
+			[]string{"flush second", "close second", "flush first", "close first"},
+			"",
+		},
+		{
+			"collects close errors",
+			errors.New("close failed"),
+			1,
+			[]string{"flush second", "close second", "flush first", "close first"},
+			"close failed; close failed",
+		},
+		{
+			"runs only once",
+			errors.New("close failed"),
+			3,
+			[]string{"flush second", "close second", "flush first", "close first"},
+			"close failed; close failed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := &lifecycleLog{}
+			first := &lifecycleExporter{name: "first", log: log, closeErr: test.closeErr}
+			second := &lifecycleExporter{name: "second", log: log, closeErr: test.closeErr}
+			shutdown := joinShutdowns(registerExporter(first), NoopShutdown, nil, registerExporter(second))
+
+			_, span := StartSpanWithSampler(context.Background(), "registered", trace.AlwaysSample())
+			span.End()
+
+			for i := 0; i < test.calls; i++ {
+				err := shutdown(context.Background())
+				if test.expectedErr == "" {
+					assert.NoError(t, err)
+				} else {
+					assert.EqualError(t, err, test.expectedErr)
+				}
+			}
+
+			_, span = StartSpanWithSampler(context.Background(), "unregistered", trace.AlwaysSample())
+			span.End()
+
+			assert.Equal(t, test.expectedEvents, log.all())
+			assert.Equal(t, []string{"registered"}, spanNames(first.spans), "exporters are unregistered")
+			assert.Equal(t, []string{"registered"}, spanNames(second.spans), "exporters are unregistered")
+		})
+	}
+}
+
+func TestShutdownFunc_ContextDeadline(t *testing.T) {
+	log := &lifecycleLog{}
+	exporter := &lifecycleExporter{name: "slow", log: log, release: make(chan struct{})}
+	shutdown := registerExporter(exporter)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, shutdown(ctx))
+
+	close(exporter.release)
+	require.NoError(t, shutdown(context.Background()), "a later call waits for the first one to complete")
+	assert.Equal(t, []string{"flush slow", "close slow"}, log.all())
+}
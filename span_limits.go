@@ -0,0 +1,291 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"go.opencensus.io/trace"
+)
+
+// TruncatedValuesAttribute is the attribute recording the number of attribute values
+// of a span that were truncated to the configured maximum length.
+const TruncatedValuesAttribute = "dtracing.truncated_values_count"
+
+// SpanLimits bounds the data recorded on a span.
+type SpanLimits struct {
+	// MaxAttributes is the maximum number of attributes, zero meaning the OpenCensus
+	// default of 32.
+	MaxAttributes int
+
+	// MaxAnnotations is the maximum number of annotations, zero meaning the OpenCensus
+	// default of 32.
+	MaxAnnotations int
+
+	// MaxMessageEvents is the maximum number of message events, zero meaning the
+	// OpenCensus default of 128.
+	MaxMessageEvents int
+
+	// MaxLinks is the maximum number of links, zero meaning the OpenCensus default of 32.
+	MaxLinks int
+
+	// MaxAttributeValueLength is the maximum length in bytes of string attribute values,
+	// longer values are truncated (on a UTF-8 character boundary). Zero disables
+	// truncation.
+	MaxAttributeValueLength int
+}
+
+// withDefaults returns the limits with the zero count limits set to the OpenCensus
+// defaults.
+func (l SpanLimits) withDefaults() SpanLimits {
+	if l.MaxAttributes == 0 {
+		l.MaxAttributes = trace.DefaultMaxAttributesPerSpan
+	}
+
+	if l.MaxAnnotations == 0 {
+		l.MaxAnnotations = trace.DefaultMaxAnnotationEventsPerSpan
+	}
+
+	if l.MaxMessageEvents == 0 {
+		l.MaxMessageEvents = trace.DefaultMaxMessageEventsPerSpan
+	}
+
+	if l.MaxLinks == 0 {
+		l.MaxLinks = trace.DefaultMaxLinksPerSpan
+	}
+
+	return l
+}
+
+func (l SpanLimits) validate() error {
+	if l.MaxAttributes < 0 || l.MaxAnnotations < 0 || l.MaxMessageEvents < 0 || l.MaxLinks < 0 || l.MaxAttributeValueLength < 0 {
+		return fmt.Errorf("span limits must not be negative")
+	}
+
+	return nil
+}
+
+var currentSpanLimits atomic.Value // SpanLimits
+
+func init() {
+	currentSpanLimits.Store(SpanLimits{})
+}
+
+// SetSpanLimits applies the count limits to OpenCensus (zero ones resetting the OpenCensus
+// defaults), which drops the oldest data once a limit is reached and records the number
+// of dropped items in the `Dropped*Count` fields of the exported `trace.SpanData`.
+// String attribute values passed to `StartSpan` (and friends) longer than
+// `MaxAttributeValueLength` are truncated, their count being recorded in the
+// `TruncatedValuesAttribute` attribute.
+//
+// Data added directly on the `trace.Span` is not truncated, wrap the exporters with
+// `NewSpanLimitingExporter` to enforce all limits before export.
+func SetSpanLimits(limits SpanLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+
+	limits = limits.withDefaults()
+	currentSpanLimits.Store(limits)
+	trace.ApplyConfig(trace.Config{
+		MaxAttributesPerSpan:       limits.MaxAttributes,
+		MaxAnnotationEventsPerSpan: limits.MaxAnnotations,
+		MaxMessageEventsPerSpan:    limits.MaxMessageEvents,
+		MaxLinksPerSpan:            limits.MaxLinks,
+	})
+
+	return nil
+}
+
+func truncateStartAttributes(attributes []trace.Attribute) []trace.Attribute {
+	maxLength := currentSpanLimits.Load().(SpanLimits).MaxAttributeValueLength
+	if maxLength <= 0 {
+		return attributes
+	}
+
+	var out []trace.Attribute
+	truncatedCount := 0
+	for i, attribute := range attributes {
+		value, ok := attribute.Value().(string)
+		if !ok {
+			continue
+		}
+
+		if truncated, wasTruncated := truncateString(value, maxLength); wasTruncated {
+			if out == nil {
+				out = append([]trace.Attribute(nil), attributes...)
+			}
+
+			out[i] = trace.StringAttribute(attribute.Key(), truncated)
+			truncatedCount++
+		}
+	}
+
+	if truncatedCount == 0 {
+		return attributes
+	}
+
+	return append(out, trace.Int64Attribute(TruncatedValuesAttribute, int64(truncatedCount)))
+}
+
+// truncateString truncates `value` to at most `maxLength` bytes without splitting a
+// UTF-8 encoded character.
+func truncateString(value string, maxLength int) (string, bool) {
+	if maxLength <= 0 || len(value) <= maxLength {
+		return value, false
+	}
+
+	cut := maxLength
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+
+	return value[:cut], true
+}
+
+// SpanLimitingExporter is a `trace.Exporter` enforcing `SpanLimits` on spans before
+// passing them to the wrapped exporter.
+type SpanLimitingExporter struct {
+	inner  trace.Exporter
+	limits SpanLimits
+}
+
+// Compile time assertion that the exporter implements trace.Exporter
+var _ trace.Exporter = (*SpanLimitingExporter)(nil)
+
+// NewSpanLimitingExporter returns an exporter enforcing `limits` on spans before exporting
+// them to `inner`. Like OpenCensus, the oldest annotations, message events and links are
+// dropped first, attributes are kept in key order. Dropped items are added to the
+// `Dropped*Count` fields and truncated string values of both span and annotation
+// attributes are counted in the `TruncatedValuesAttribute` attribute.
+//
+// Flushing and closing the exporter flushes and closes `inner` if it has a `Flush()` or
+// `Close() error` method.
+func NewSpanLimitingExporter(inner trace.Exporter, limits SpanLimits) (*SpanLimitingExporter, error) {
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+
+	return &SpanLimitingExporter{inner: inner, limits: limits.withDefaults()}, nil
+}
+
+func (e *SpanLimitingExporter) ExportSpan(span *trace.SpanData) {
+	e.inner.ExportSpan(e.limitSpan(span))
+}
+
+func (e *SpanLimitingExporter) limitSpan(span *trace.SpanData) *trace.SpanData {
+	limited := *span
+	truncatedCount := 0
+
+	var dropped, truncated int
+	limited.Attributes, dropped, truncated = e.limitAttributes(span.Attributes, e.limits.MaxAttributes)
+	limited.DroppedAttributeCount += dropped
+	truncatedCount += truncated
+
+	if len(span.Annotations) > 0 {
+		annotations := keepLatest(len(span.Annotations), e.limits.MaxAnnotations)
+		limited.DroppedAnnotationCount += len(span.Annotations) - annotations
+
+		limited.Annotations = make([]trace.Annotation, annotations)
+		for i, annotation := range span.Annotations[len(span.Annotations)-annotations:] {
+			limited.Annotations[i] = annotation
+			limited.Annotations[i].Attributes, _, truncated = e.limitAttributes(annotation.Attributes, 0)
+			truncatedCount += truncated
+		}
+	}
+
+	if count := keepLatest(len(span.MessageEvents), e.limits.MaxMessageEvents); count < len(span.MessageEvents) {
+		limited.DroppedMessageEventCount += len(span.MessageEvents) - count
+		limited.MessageEvents = span.MessageEvents[len(span.MessageEvents)-count:]
+	}
+
+	if count := keepLatest(len(span.Links), e.limits.MaxLinks); count < len(span.Links) {
+		limited.DroppedLinkCount += len(span.Links) - count
+		limited.Links = span.Links[len(span.Links)-count:]
+	}
+
+	if truncatedCount > 0 {
+		if limited.Attributes == nil {
+			limited.Attributes = map[string]interface{}{}
+		}
+
+		previousCount, _ := limited.Attributes[TruncatedValuesAttribute].(int64)
+		limited.Attributes[TruncatedValuesAttribute] = previousCount + int64(truncatedCount)
+	}
+
+	return &limited
+}
+
+// limitAttributes returns a copy of `attributes` holding at most `maxCount` of them
+// (unbounded if zero), kept in key order, with string values truncated.
+func (e *SpanLimitingExporter) limitAttributes(attributes map[string]interface{}, maxCount int) (out map[string]interface{}, dropped int, truncated int) {
+	if attributes == nil {
+		return nil, 0, 0
+	}
+
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if maxCount > 0 && len(keys) > maxCount {
+		dropped = len(keys) - maxCount
+		keys = keys[:maxCount]
+	}
+
+	out = make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		value := attributes[key]
+		if s, ok := value.(string); ok {
+			if truncatedValue, wasTruncated := truncateString(s, e.limits.MaxAttributeValueLength); wasTruncated {
+				value = truncatedValue
+				truncated++
+			}
+		}
+
+		out[key] = value
+	}
+
+	return out, dropped, truncated
+}
+
+// keepLatest returns how many of `count` items are kept with the `maxCount` limit, zero
+// being unbounded.
+func keepLatest(count int, maxCount int) int {
+	if maxCount > 0 && count > maxCount {
+		return maxCount
+	}
+
+	return count
+}
+
+func (e *SpanLimitingExporter) Flush() {
+	if f, ok := e.inner.(flusher); ok {
+		f.Flush()
+	}
+}
+
+func (e *SpanLimitingExporter) Close() error {
+	if c, ok := e.inner.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+)
+
+func TestSetSpanLimits(t *testing.T) {
+	require.NoError(t, SetSpanLimits(SpanLimits{MaxAnnotations: 2, MaxAttributeValueLength: 4}))
+	defer SetSpanLimits(SpanLimits{})
+
+	exporter := &capturingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	_, span := StartSpanWithSampler(context.Background(), "span", trace.AlwaysSample(), "short", "abc", "long", "abcdef", "unicode", "abcé")
+	for i := 0; i < 5; i++ {
+		span.Annotate(nil, "annotation")
+	}
+	span.End()
+
+	require.Len(t, exporter.spans, 1)
+	assert.Equal(t, map[string]interface{}{
+		"short":                  "abc",
+		"long":                   "abcd",
+		"unicode":                "abc",
+		TruncatedValuesAttribute: int64(2),
+	}, exporter.spans[0].Attributes)
+	assert.Len(t, exporter.spans[0].Annotations, 2)
+	assert.Equal(t, 3, exporter.spans[0].DroppedAnnotationCount)
+}
+
+func TestSpanLimitingExporter(t *testing.T) {
+	inner := &capturingExporter{}
+	exporter, err := NewSpanLimitingExporter(inner, SpanLimits{MaxAttributes: 2, MaxAnnotations: 1, MaxLinks: 1, MaxAttributeValueLength: 3})
+	require.NoError(t, err)
+
+	exporter.ExportSpan(&trace.SpanData{
+		Name:                  "span",
+		Attributes:            map[string]interface{}{"c": "dropped", "a": "abcdef", "b": int64(1)},
+		DroppedAttributeCount: 1,
+		Annotations: []trace.Annotation{
+			{Message: "first"},
+			{Message: "second", Attributes: map[string]interface{}{"key": "value"}},
+		},
+		Links:         []trace.Link{{Type: trace.LinkTypeChild}, {Type: trace.LinkTypeParent}},
+		MessageEvents: []trace.MessageEvent{{}, {}},
+	})
+
+	require.Len(t, inner.spans, 1)
+	span := inner.spans[0]
+
+	assert.Equal(t, map[string]interface{}{"a": "abc", "b": int64(1), TruncatedValuesAttribute: int64(2)}, span.Attributes)
+	assert.Equal(t, 2, span.DroppedAttributeCount)
+	assert.Equal(t, []trace.Annotation{{Message: "second", Attributes: map[string]interface{}{"key": "val"}}}, span.Annotations)
+	assert.Equal(t, 1, span.DroppedAnnotationCount)
+	assert.Equal(t, []trace.Link{{Type: trace.LinkTypeParent}}, span.Links)
+	assert.Equal(t, 1, span.DroppedLinkCount)
+	assert.Len(t, span.MessageEvents, 2)
+	assert.Equal(t, 0, span.DroppedMessageEventCount)
+
+	attributes := map[string]interface{}{}
+	for i := 0; i < 40; i++ {
+		attributes[fmt.Sprintf("key_%02d", i)] = int64(i)
+	}
+
+	exporter, err = NewSpanLimitingExporter(inner, SpanLimits{})
+	require.NoError(t, err)
+	exporter.ExportSpan(&trace.SpanData{Name: "defaults", Attributes: attributes})
+
+	require.Len(t, inner.spans, 2)
+	assert.Len(t, inner.spans[1].Attributes, trace.DefaultMaxAttributesPerSpan, "zero limits are the OpenCensus defaults")
+	assert.Equal(t, 40-trace.DefaultMaxAttributesPerSpan, inner.spans[1].DroppedAttributeCount)
+
+	_, err = NewSpanLimitingExporter(inner, SpanLimits{MaxAttributes: -1})
+	assert.EqualError(t, err, "span limits must not be negative")
+}
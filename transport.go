@@ -0,0 +1,267 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+)
+
+const retryCountAttribute = "http.retry_count"
+
+// TransportOption configures the transport returned by `NewTransport`.
+type TransportOption func(transport *Transport)
+
+// WithTransportPropagation sets the format used to inject the span context in outgoing
+// requests, defaults to the same format the middleware uses.
+func WithTransportPropagation(format propagation.HTTPFormat) TransportOption {
+	return func(transport *Transport) {
+		transport.propagation = format
+	}
+}
+
+// WithTransportSampler sets the sampler used for the client spans, the default sampler is
+// used otherwise.
+func WithTransportSampler(sampler trace.Sampler) TransportOption {
+	return func(transport *Transport) {
+		transport.sampler = sampler
+	}
+}
+
+// WithTransportSpanNameFunc sets the function resolving the name of the client span of a
+// request, defaults to the request's URL path.
+func WithTransportSpanNameFunc(spanNameFunc func(r *http.Request) string) TransportOption {
+	return func(transport *Transport) {
+		transport.spanNameFunc = spanNameFunc
+	}
+}
+
+// WithTransportRetry retries requests failing with a transport error or a `502`, `503` or
+// `504` status code, up to `maxRetries` times, waiting `backoff` (doubled on each retry)
+// between attempts. Only requests without a body or with `GetBody` defined are retried.
+//
+// Since a failed request may still have been processed by the server, only idempotent
+// requests are retried: `GET`, `HEAD`, `OPTIONS`, `TRACE`, `PUT` and `DELETE` ones or
+// requests having an `Idempotency-Key` header. See `WithTransportRetryNonIdempotent`
+// to retry all requests.
+func WithTransportRetry(maxRetries int, backoff time.Duration) TransportOption {
+	return func(transport *Transport) {
+		transport.maxRetries = maxRetries
+		transport.retryBackoff = backoff
+	}
+}
+
+// WithTransportRetryNonIdempotent also retries non-idempotent requests (`POST`, `PATCH`,
+// ...), which may then be processed more than once by the server, see `WithTransportRetry`.
+func WithTransportRetryNonIdempotent() TransportOption {
+	return func(transport *Transport) {
+		transport.retryNonIdempotent = true
+	}
+}
+
+// Transport is an `http.RoundTripper` that starts a client span for every request and
+// injects the span context in the outgoing request headers.
+type Transport struct {
+	base         http.RoundTripper
+	propagation  propagation.HTTPFormat
+	sampler      trace.Sampler
+	spanNameFunc func(r *http.Request) string
+	maxRetries   int
+	retryBackoff time.Duration
+
+	retryNonIdempotent bool
+}
+
+// Compile time assertion that the transport implements http.RoundTripper
+var _ http.RoundTripper = (*Transport)(nil)
+
+// NewTransport returns an `http.RoundTripper` wrapping `base` (`http.DefaultTransport` if
+// nil) that starts a client span, child of the span found in the request's context, for
+// every request. The span context is injected in the request headers using the same
+// propagation format the middleware understands, unless configured otherwise.
+//
+// The span records the method, URL, status code and retry count of the request and its
+// status is derived from the HTTP status code or from the transport error. The span ends
+// when the response body is fully read or closed.
+func NewTransport(base http.RoundTripper, options ...TransportOption) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	transport := &Transport{
+		base:         base,
+		spanNameFunc: func(r *http.Request) string { return r.URL.Path },
+	}
+
+	for _, option := range options {
+		option(transport)
+	}
+
+	return transport
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	startOptions := []trace.StartOption{trace.WithSpanKind(trace.SpanKindClient)}
+	if t.sampler != nil {
+		startOptions = append(startOptions, trace.WithSampler(t.sampler))
+	}
+
+	ctx, span := trace.StartSpan(req.Context(), t.spanNameFunc(req), startOptions...)
+	span.AddAttributes(
+		trace.StringAttribute(ochttp.MethodAttribute, req.Method),
+		trace.StringAttribute(ochttp.URLAttribute, req.URL.String()),
+		trace.StringAttribute(ochttp.HostAttribute, req.URL.Host),
+		trace.StringAttribute(ochttp.PathAttribute, req.URL.Path),
+	)
+
+	format := t.propagation
+	if format == nil {
+		format = getDefaultFormat()
+	}
+
+	var response *http.Response
+	var err error
+	retries := 0
+	for {
+		attemptReq := req.Clone(ctx)
+		if retries > 0 && req.GetBody != nil {
+			if attemptReq.Body, err = req.GetBody(); err != nil {
+				break
+			}
+		}
+
+		format.SpanContextToRequest(span.SpanContext(), attemptReq)
+		response, err = t.base.RoundTrip(attemptReq)
+
+		if retries >= t.maxRetries || !t.shouldRetry(req, response, err) {
+			break
+		}
+
+		annotation := []trace.Attribute{trace.Int64Attribute("attempt", int64(retries+1))}
+		if err != nil {
+			annotation = append(annotation, trace.StringAttribute("error", err.Error()))
+		} else {
+			annotation = append(annotation, trace.Int64Attribute(ochttp.StatusCodeAttribute, int64(response.StatusCode)))
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		}
+		span.Annotate(annotation, "retrying request")
+
+		if waitErr := sleepContext(ctx, t.retryBackoff<<uint(retries)); waitErr != nil {
+			err = waitErr
+			response = nil
+			break
+		}
+
+		retries++
+	}
+
+	span.AddAttributes(trace.Int64Attribute(retryCountAttribute, int64(retries)))
+
+	if err != nil {
+		span.SetStatus(StatusFromError(err))
+		span.End()
+		return nil, err
+	}
+
+	span.AddAttributes(trace.Int64Attribute(ochttp.StatusCodeAttribute, int64(response.StatusCode)))
+	span.SetStatus(ochttp.TraceStatus(response.StatusCode, response.Status))
+
+	if response.Body == nil || response.Body == http.NoBody {
+		span.End()
+		return response, nil
+	}
+
+	response.Body = &spanEndingBody{ReadCloser: response.Body, span: span}
+	return response, nil
+}
+
+func (t *Transport) shouldRetry(req *http.Request, response *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	if !t.retryNonIdempotent && !isIdempotent(req) {
+		return false
+	}
+
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+
+	switch response.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// spanEndingBody ends the span once the body has been fully read or closed.
+type spanEndingBody struct {
+	io.ReadCloser
+
+	span *trace.Span
+	once sync.Once
+}
+
+func (b *spanEndingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.span.End)
+	} else if err != nil {
+		b.once.Do(func() {
+			b.span.Annotate([]trace.Attribute{trace.StringAttribute("error", err.Error())}, "reading response body failed")
+			b.span.End()
+		})
+	}
+
+	return n, err
+}
+
+func (b *spanEndingBody) Close() error {
+	b.once.Do(b.span.End)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+)
+
+func TestTransport(t *testing.T) {
+	exporter := &capturingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	var calls int32
+	var traceparents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewTransport(nil, WithTransportSampler(trace.AlwaysSample()), WithTransportRetry(2, time.Millisecond))}
+
+	ctx, parent := trace.StartSpan(context.Background(), "parent", trace.WithSampler(trace.AlwaysSample()))
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/resource", nil)
+	require.NoError(t, err)
+
+	response, err := client.Do(req)
+	require.NoError(t, err)
+
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	parent.End()
+
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, int32(2), calls)
+
+	require.Len(t, exporter.spans, 2)
+	span := exporter.spans[0]
+
+	assert.Equal(t, "/resource", span.Name)
+	assert.Equal(t, trace.SpanKindClient, span.SpanKind)
+	assert.Equal(t, parent.SpanContext().SpanID, span.ParentSpanID)
+	assert.Equal(t, int64(200), span.Attributes["http.status_code"])
+	assert.Equal(t, int64(1), span.Attributes["http.retry_count"])
+	assert.Equal(t, int32(trace.StatusCodeOK), span.Code)
+	require.Len(t, span.Annotations, 1)
+	assert.Equal(t, "retrying request", span.Annotations[0].Message)
+
+	expectedTraceparent := "00-" + span.TraceID.String() + "-" + span.SpanID.String() + "-01"
+	assert.Equal(t, []string{expectedTraceparent, expectedTraceparent}, traceparents)
+}
+
+func TestTransport_RetryIdempotentOnly(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		header        http.Header
+		options       []TransportOption
+		expectedCalls int32
+	}{
+		{"put", "PUT", nil, nil, 2},
+		{"post", "POST", nil, nil, 1},
+		{"patch", "PATCH", nil, nil, 1},
+		{"post with idempotency key", "POST", http.Header{"Idempotency-Key": []string{"key"}}, nil, 2},
+		{"post opted in", "POST", nil, []TransportOption{WithTransportRetryNonIdempotent()}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer server.Close()
+
+			options := append([]TransportOption{WithTransportRetry(1, time.Millisecond)}, test.options...)
+			client := &http.Client{Transport: NewTransport(nil, options...)}
+
+			req, err := http.NewRequest(test.method, server.URL, strings.NewReader("body"))
+			require.NoError(t, err)
+			for key, values := range test.header {
+				req.Header[key] = values
+			}
+
+			response, err := client.Do(req)
+			require.NoError(t, err)
+			require.NoError(t, response.Body.Close())
+
+			assert.Equal(t, test.expectedCalls, atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestTransport_Error(t *testing.T) {
+	exporter := &capturingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	client := &http.Client{Transport: NewTransport(nil, WithTransportSampler(trace.AlwaysSample()))}
+	_, err := client.Post(server.URL, "text/plain", strings.NewReader("body"))
+	require.Error(t, err)
+
+	require.Len(t, exporter.spans, 1)
+	assert.Equal(t, int32(trace.StatusCodeUnknown), exporter.spans[0].Code)
+	assert.Equal(t, int64(0), exporter.spans[0].Attributes["http.retry_count"])
+}
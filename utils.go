@@ -17,6 +17,8 @@ package dtracing
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"strings"
 
 	"github.com/streamingfast/logging"
 	"go.opencensus.io/trace"
@@ -29,10 +31,14 @@ import (
 //
 // If you are creating your span in a tight loop, you are better off using `StartSpanA`
 // which accepts `trace.Attribute` directly.
+//
+// Attributes are redacted by the redactor set through `SetSpanRedactor`, if any, and
+// string values are truncated according to `SetSpanLimits`. Root spans are sampled
+// using the attribute aware rules set through `SetDefaultSamplingRules`, if any.
+//
+// `SpanOption` values (like `EnrichLogger()`) can be mixed with the keyed attributes.
 func StartSpan(ctx context.Context, name string, keyedAttributes ...interface{}) (context.Context, *trace.Span) {
-	logger := logging.Logger(ctx, zlog)
-
-	return StartSpanWithSamplerA(ctx, name, nil, keyedAttributesToTraceAttributes(logger, keyedAttributes)...)
+	return StartSpanWithSampler(ctx, name, nil, keyedAttributes...)
 }
 
 // StartSpanA starts a `trace.Span` which accepts a variadic list of `trace.Attribute` directly.
@@ -44,29 +50,39 @@ func StartSpanA(ctx context.Context, name string, attributes ...trace.Attribute)
 // arguments alongside a new `sampler`.
 func StartSpanWithSampler(ctx context.Context, name string, sampler trace.Sampler, keyedAttributes ...interface{}) (context.Context, *trace.Span) {
 	logger := logging.Logger(ctx, zlog)
+	keyedAttributes, spanOptions := extractSpanOptions(keyedAttributes)
+	annotateError := handleAttributeErrors(ctx, logger, keyedAttributes)
+	attributes := keyedAttributesToTraceAttributes(logger, keyedAttributes)
+
+	childCtx, span := StartSpanWithSamplerA(ctx, name, sampler, attributes...)
+	if annotateError {
+		annotateAttributeError(span)
+	}
 
-	return StartSpanWithSamplerA(ctx, name, sampler, keyedAttributesToTraceAttributes(logger, keyedAttributes)...)
+	return applySpanOptions(childCtx, span, spanOptions), span
 }
 
 // StartSpanWithSamplerA starts a `trace.Span` just like `StartSpanA` accepting the same set of
 // arguments alongside a new `sampler` value for the trace.
 func StartSpanWithSamplerA(ctx context.Context, name string, sampler trace.Sampler, attributes ...trace.Attribute) (context.Context, *trace.Span) {
+	if trace.FromContext(ctx) == nil {
+		sampler = startSampler(sampler, attributes)
+	}
+
 	var startOptions []trace.StartOption
 	if sampler != nil {
 		startOptions = append(startOptions, trace.WithSampler(sampler))
 	}
 
 	childCtx, span := trace.StartSpan(ctx, name, startOptions...)
-	span.AddAttributes(attributes...)
+	span.AddAttributes(truncateStartAttributes(redactStartAttributes(attributes))...)
 
 	return childCtx, span
 }
 
 // StartFreshSpan has exact same behavior as StartSpan expect it always starts new fresh trace & span
 func StartFreshSpan(ctx context.Context, name string, keyedAttributes ...interface{}) (context.Context, *trace.Span) {
-	logger := logging.Logger(ctx, zlog)
-
-	return StartFreshSpanWithSamplerA(ctx, name, nil, keyedAttributesToTraceAttributes(logger, keyedAttributes)...)
+	return StartFreshSpanWithSampler(ctx, name, nil, keyedAttributes...)
 }
 
 // StartFreshSpanWithSamplerA has exact same behavior as StartSpanWithSamplerA expect it always starts new fresh trace & span
@@ -77,53 +93,46 @@ func StartFreshSpanA(ctx context.Context, name string, attributes ...trace.Attri
 // StartFreshSpanWithSampler has exact same behavior as StartSpanWithSampler expect it always starts new fresh trace & span
 func StartFreshSpanWithSampler(ctx context.Context, name string, sampler trace.Sampler, keyedAttributes ...interface{}) (context.Context, *trace.Span) {
 	logger := logging.Logger(ctx, zlog)
+	keyedAttributes, spanOptions := extractSpanOptions(keyedAttributes)
+	annotateError := handleAttributeErrors(ctx, logger, keyedAttributes)
+	attributes := keyedAttributesToTraceAttributes(logger, keyedAttributes)
+
+	childCtx, span := StartFreshSpanWithSamplerA(ctx, name, sampler, attributes...)
+	if annotateError {
+		annotateAttributeError(span)
+	}
 
-	return StartFreshSpanWithSamplerA(ctx, name, sampler, keyedAttributesToTraceAttributes(logger, keyedAttributes)...)
+	return applySpanOptions(childCtx, span, spanOptions), span
 }
 
 var emptySpanContext = trace.SpanContext{}
 
 // StartFreshSpanWithSamplerA has exact same behavior as StartSpanWithSamplerA expect it always starts new fresh trace & span
 func StartFreshSpanWithSamplerA(ctx context.Context, name string, sampler trace.Sampler, attributes ...trace.Attribute) (context.Context, *trace.Span) {
+	sampler = startSampler(sampler, attributes)
+
 	var startOptions []trace.StartOption
 	if sampler != nil {
 		startOptions = append(startOptions, trace.WithSampler(sampler))
 	}
 
 	childCtx, span := trace.StartSpanWithRemoteParent(ctx, name, emptySpanContext, startOptions...)
-	span.AddAttributes(attributes...)
+	span.AddAttributes(truncateStartAttributes(redactStartAttributes(attributes))...)
 
 	return childCtx, span
 }
 
+// keyedAttributesToTraceAttributes converts keyed attributes to `trace.Attribute`, the
+// last value being ignored when there is an odd number of them (see `handleAttributeErrors`).
 func keyedAttributesToTraceAttributes(logger *zap.Logger, keyedAttributes []interface{}) []trace.Attribute {
-	keyedAttributeCount := len(keyedAttributes)
+	keyedAttributeCount := len(keyedAttributes) - len(keyedAttributes)%2
 	if keyedAttributeCount <= 0 {
 		return nil
 	}
 
-	if keyedAttributeCount%2 != 0 {
-		logger.Panic("keyedAttributes parameters should be a multiple of 2", zap.Any("keyed_attributes", keyedAttributes))
-	}
-
 	attributes := make([]trace.Attribute, keyedAttributeCount/2)
 	for i := 0; i < keyedAttributeCount; i += 2 {
-		key := toString(keyedAttributes[i])
-		value := keyedAttributes[i+1]
-		attributeIndex := (i + 1) / 2
-
-		switch v := value.(type) {
-		case int, int8, int16, int32, int64, uintptr, uint, uint8, uint16, uint32, uint64:
-			attributes[attributeIndex] = trace.Int64Attribute(key, toInt64(v))
-		case bool:
-			attributes[attributeIndex] = trace.BoolAttribute(key, v)
-		case fmt.Stringer:
-			attributes[attributeIndex] = trace.StringAttribute(key, v.String())
-		case string:
-			attributes[attributeIndex] = trace.StringAttribute(key, v)
-		default:
-			logger.Panic("trace attribute must be a integer, a boolean or a string/stringer", zap.String("type", fmt.Sprintf("%T", value)))
-		}
+		attributes[i/2] = toTraceAttribute(logger, toString(keyedAttributes[i]), keyedAttributes[i+1])
 	}
 
 	return attributes
@@ -140,6 +149,27 @@ func toString(input interface{}) string {
 	}
 }
 
+// compileGlob compiles a glob `pattern` where `*` matches any sequence of characters
+// (including `/`) and `?` matches exactly one character, everything else matching
+// literally.
+func compileGlob(pattern string) *regexp.Regexp {
+	var builder strings.Builder
+	builder.WriteString("(?s)^")
+	for _, char := range pattern {
+		switch char {
+		case '*':
+			builder.WriteString(".*")
+		case '?':
+			builder.WriteString(".")
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	builder.WriteString("$")
+
+	return regexp.MustCompile(builder.String())
+}
+
 func toInt64(value interface{}) int64 {
 	switch v := value.(type) {
 	case int:
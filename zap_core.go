@@ -0,0 +1,215 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"sort"
+
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	spanFieldKey = "dtracing_span"
+
+	// logLevelAttribute is set on annotations created from log entries, it's used
+	// to recognize them and avoid logging them back.
+	logLevelAttribute         = "log.level"
+	logDroppedFieldsAttribute = "log.dropped_fields"
+)
+
+// spanField is a field invisible to encoders holding the span a logger is bound to.
+func spanField(span *trace.Span) zap.Field {
+	return zap.Field{Key: spanFieldKey, Type: zapcore.SkipType, Interface: span}
+}
+
+func spanFromField(field zapcore.Field) (*trace.Span, bool) {
+	if field.Type != zapcore.SkipType || field.Key != spanFieldKey {
+		return nil, false
+	}
+
+	span, ok := field.Interface.(*trace.Span)
+	return span, ok
+}
+
+// SpanAnnotatingCoreOption configures the core returned by `NewSpanAnnotatingCore`.
+type SpanAnnotatingCoreOption func(core *spanAnnotatingCore)
+
+// WithAnnotationLevel sets the minimum level of the log entries recorded as annotations,
+// defaults to `zapcore.InfoLevel`.
+func WithAnnotationLevel(level zapcore.LevelEnabler) SpanAnnotatingCoreOption {
+	return func(core *spanAnnotatingCore) {
+		core.level = level
+	}
+}
+
+// WithAnnotationMaxFields sets the maximum number of fields of a log entry recorded as
+// annotation attributes, the number of fields dropped being recorded under the
+// `log.dropped_fields` attribute. Defaults to 16.
+func WithAnnotationMaxFields(maxFields int) SpanAnnotatingCoreOption {
+	return func(core *spanAnnotatingCore) {
+		core.maxFields = maxFields
+	}
+}
+
+// NewSpanAnnotatingCore wraps `core` so that the entries logged through a logger bound
+// to a sampled span (like the loggers returned by `Logger`, `EnrichLogger`, the
+// middlewares and the gRPC interceptors) are also recorded as an annotation on that span.
+// The annotation message is the log message and its attributes are the fields of the
+// entry along with the `log.level` attribute. Entries are written to `core` as usual.
+//
+//	logger := zap.New(dtracing.NewSpanAnnotatingCore(core), zap.WrapCore(...))
+func NewSpanAnnotatingCore(core zapcore.Core, options ...SpanAnnotatingCoreOption) zapcore.Core {
+	annotatingCore := &spanAnnotatingCore{
+		Core:      core,
+		level:     zapcore.InfoLevel,
+		maxFields: 16,
+	}
+
+	for _, option := range options {
+		option(annotatingCore)
+	}
+
+	return annotatingCore
+}
+
+type spanAnnotatingCore struct {
+	zapcore.Core
+
+	level     zapcore.LevelEnabler
+	maxFields int
+
+	// Span the core is bound to through `With`, if any
+	span *trace.Span
+}
+
+func (c *spanAnnotatingCore) Enabled(level zapcore.Level) bool {
+	return c.Core.Enabled(level) || c.level.Enabled(level)
+}
+
+func (c *spanAnnotatingCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.Core = c.Core.With(fields)
+	for _, field := range fields {
+		if span, ok := spanFromField(field); ok {
+			clone.span = span
+		}
+	}
+
+	return &clone
+}
+
+func (c *spanAnnotatingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.level.Enabled(entry.Level) {
+		checked = checked.AddCore(entry, annotatingWriter{c})
+	}
+
+	return c.Core.Check(entry, checked)
+}
+
+// annotate records the entry as an annotation of the span the core, or one of the entry
+// fields, is bound to.
+func (c *spanAnnotatingCore) annotate(entry zapcore.Entry, fields []zapcore.Field) {
+	span := c.span
+	for _, field := range fields {
+		if fieldSpan, ok := spanFromField(field); ok {
+			span = fieldSpan
+		}
+	}
+
+	if span == nil || !span.IsRecordingEvents() {
+		return
+	}
+
+	attributes := []trace.Attribute{trace.StringAttribute(logLevelAttribute, entry.Level.String())}
+	dropped := 0
+	for _, field := range fields {
+		if field.Type == zapcore.SkipType {
+			continue
+		}
+
+		encoder := zapcore.NewMapObjectEncoder()
+		field.AddTo(encoder)
+		for key, value := range encoder.Fields {
+			if len(attributes)-1 >= c.maxFields {
+				dropped++
+				continue
+			}
+
+			attributes = append(attributes, toTraceAttribute(zap.NewNop(), key, value))
+		}
+	}
+
+	if dropped > 0 {
+		attributes = append(attributes, trace.Int64Attribute(logDroppedFieldsAttribute, int64(dropped)))
+	}
+
+	span.Annotate(attributes, entry.Message)
+}
+
+// annotatingWriter is the core added to checked entries so that only the annotation
+// is performed on `Write`, the wrapped core being added on its own.
+type annotatingWriter struct {
+	*spanAnnotatingCore
+}
+
+func (w annotatingWriter) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	w.annotate(entry, fields)
+	return nil
+}
+
+func (w annotatingWriter) Sync() error {
+	return nil
+}
+
+// NewAnnotationLoggingExporter returns an exporter that logs a line, at info level, for
+// each annotation of the exported spans, the log message being the annotation message
+// and the annotation attributes being logged as fields. Annotations created from log
+// entries by `NewSpanAnnotatingCore` are skipped.
+func NewAnnotationLoggingExporter(logger *zap.Logger) trace.Exporter {
+	return &annotationLoggingExporter{logger: logger}
+}
+
+type annotationLoggingExporter struct {
+	logger *zap.Logger
+}
+
+func (e *annotationLoggingExporter) ExportSpan(span *trace.SpanData) {
+	for _, annotation := range span.Annotations {
+		if _, fromLog := annotation.Attributes[logLevelAttribute]; fromLog {
+			continue
+		}
+
+		fields := make([]zap.Field, 0, len(annotation.Attributes)+4)
+		fields = append(fields,
+			zap.String("span_name", span.Name),
+			zap.Stringer("trace_id", span.TraceID),
+			zap.Stringer("span_id", span.SpanID),
+			zap.Time("annotation_time", annotation.Time),
+		)
+		keys := make([]string, 0, len(annotation.Attributes))
+		for key := range annotation.Attributes {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+		for _, key := range keys {
+			fields = append(fields, zap.Any(key, annotation.Attributes[key]))
+		}
+
+		e.logger.Info(annotation.Message, fields...)
+	}
+}
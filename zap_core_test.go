@@ -0,0 +1,82 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streamingfast/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSpanAnnotatingCore(t *testing.T) {
+	exporter := &capturingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	core, logs := observer.New(zap.DebugLevel)
+	logger := zap.New(NewSpanAnnotatingCore(core, WithAnnotationMaxFields(2)))
+	ctx := logging.WithLogger(context.Background(), logger)
+
+	ctx, span := StartSpanWithSampler(ctx, "sampled", trace.AlwaysSample(), EnrichLogger())
+	logging.Logger(ctx, zlog).Debug("filtered by level")
+	logging.Logger(ctx, zlog).Info("fetched block", zap.Int("block_num", 10), zap.String("id", "abc"), zap.Bool("cached", true))
+	span.End()
+
+	unsampledCtx, unsampled := StartSpanWithSampler(context.Background(), "unsampled", trace.NeverSample())
+	Logger(unsampledCtx, logger).Info("not recorded")
+	unsampled.End()
+
+	assert.Equal(t, 3, logs.Len())
+	assert.NotContains(t, logs.All()[1].ContextMap(), spanFieldKey)
+
+	require.Len(t, exporter.spans, 1)
+	require.Len(t, exporter.spans[0].Annotations, 1)
+
+	annotation := exporter.spans[0].Annotations[0]
+	assert.Equal(t, "fetched block", annotation.Message)
+	assert.Equal(t, map[string]interface{}{
+		"log.level":          "info",
+		"block_num":          int64(10),
+		"id":                 "abc",
+		"log.dropped_fields": int64(1),
+	}, annotation.Attributes)
+}
+
+func TestAnnotationLoggingExporter(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	exporter := NewAnnotationLoggingExporter(zap.New(core))
+
+	exporter.ExportSpan(&trace.SpanData{
+		Name: "span",
+		Annotations: []trace.Annotation{
+			{Message: "cache miss", Attributes: map[string]interface{}{"key": "block"}},
+			{Message: "from log", Attributes: map[string]interface{}{"log.level": "info"}},
+		},
+	})
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 1)
+	assert.Equal(t, zapcore.InfoLevel, entries[0].Level)
+	assert.Equal(t, "cache miss", entries[0].Message)
+	assert.Equal(t, "span", entries[0].ContextMap()["span_name"])
+	assert.Equal(t, "block", entries[0].ContextMap()["key"])
+}
@@ -15,35 +15,423 @@
 package dtracing
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
-type zapExporter struct{}
+const defaultZapExporterMaxBufferedTraces = 1000
+
+// ZapExporterOption configures the exporter returned by `NewZapExporter`.
+type ZapExporterOption func(exporter *ZapExporter)
+
+// WithZapExporterLevel sets the level at which successful spans are logged, defaults
+// to `zapcore.DebugLevel`. Failed spans are always logged at warn or error level.
+func WithZapExporterLevel(level zapcore.Level) ZapExporterOption {
+	return func(exporter *ZapExporter) {
+		exporter.level = level
+	}
+}
+
+// WithZapExporterTreeMode buffers the spans of a trace until its local root span ends
+// and then logs the whole trace at once, as an indented tree with per-span timings.
+// At most `maxBufferedTraces` traces are buffered, the oldest one being logged as is
+// when the limit is reached. Spans ending after their local root are logged right away
+// as their own entry, with the `late` field set, as long as their trace is among the
+// last `maxBufferedTraces` ones logged.
+func WithZapExporterTreeMode(maxBufferedTraces int) ZapExporterOption {
+	return func(exporter *ZapExporter) {
+		exporter.treeMode = true
+		exporter.maxBufferedTraces = maxBufferedTraces
+	}
+}
+
+// ZapExporter is a `trace.Exporter` (and `view.Exporter`) logging spans through a
+// `zap.Logger`.
+type ZapExporter struct {
+	logger            *zap.Logger
+	level             zapcore.Level
+	treeMode          bool
+	maxBufferedTraces int
+
+	lock        sync.Mutex
+	traces      map[trace.TraceID][]*trace.SpanData
+	tracesOrder []trace.TraceID
+
+	// completed holds the most recently logged traces, to recognize their late spans
+	completed      map[trace.TraceID]struct{}
+	completedOrder []trace.TraceID
+}
+
+// Compile time assertion that the exporter implements trace.Exporter and view.Exporter
+var _ trace.Exporter = (*ZapExporter)(nil)
+var _ view.Exporter = (*ZapExporter)(nil)
 
-// Compile time assertion that the exporter implements trace.Exporter
-var _ trace.Exporter = (*zapExporter)(nil)
+// NewZapExporter returns an exporter logging every span, with all of its data as
+// structured fields, through `logger`. Successful spans are logged at debug level
+// (see `WithZapExporterLevel`), spans with a server-side failure status (`UNKNOWN`,
+// `DEADLINE_EXCEEDED`, `UNIMPLEMENTED`, `INTERNAL`, `UNAVAILABLE` or `DATA_LOSS`) at
+// error level and other failed spans at warn level.
+func NewZapExporter(logger *zap.Logger, options ...ZapExporterOption) *ZapExporter {
+	exporter := &ZapExporter{
+		logger:            logger,
+		level:             zapcore.DebugLevel,
+		maxBufferedTraces: defaultZapExporterMaxBufferedTraces,
+		traces:            map[trace.TraceID][]*trace.SpanData{},
+		completed:         map[trace.TraceID]struct{}{},
+	}
 
-func (exporter *zapExporter) ExportSpan(span *trace.SpanData) {
-	elapsed := span.EndTime.Sub(span.StartTime)
+	for _, option := range options {
+		option(exporter)
+	}
+
+	return exporter
+}
+
+func (e *ZapExporter) ExportSpan(span *trace.SpanData) {
+	if !e.treeMode {
+		e.logSpan(span)
+		return
+	}
+
+	isLocalRoot := span.ParentSpanID == (trace.SpanID{}) || span.HasRemoteParent
+
+	e.lock.Lock()
+	spans, buffered := e.traces[span.TraceID]
+	if !buffered && isLocalRoot {
+		// Trace only has a single span, no need to buffer anything
+		e.markCompleted(span.TraceID)
+		e.lock.Unlock()
+		e.logTree(span.TraceID, []*trace.SpanData{span}, false)
+		return
+	}
+
+	if _, completed := e.completed[span.TraceID]; !buffered && completed {
+		// The local root was already logged, waiting for it would never happen
+		e.lock.Unlock()
+		e.logTree(span.TraceID, []*trace.SpanData{span}, true)
+		return
+	}
+
+	if !buffered {
+		e.tracesOrder = append(e.tracesOrder, span.TraceID)
+	}
+
+	e.traces[span.TraceID] = append(spans, span)
+
+	var completed map[trace.TraceID][]*trace.SpanData
+	if isLocalRoot {
+		completed = map[trace.TraceID][]*trace.SpanData{span.TraceID: e.removeTrace(span.TraceID)}
+		e.markCompleted(span.TraceID)
+	} else if len(e.tracesOrder) > e.maxBufferedTraces {
+		oldest := e.tracesOrder[0]
+		completed = map[trace.TraceID][]*trace.SpanData{oldest: e.removeTrace(oldest)}
+	}
+	e.lock.Unlock()
+
+	for traceID, spans := range completed {
+		e.logTree(traceID, spans, false)
+	}
+}
 
-	zlog.Debug("trace span",
+// Flush logs all the traces buffered in tree mode, even if their root span did not end.
+func (e *ZapExporter) Flush() {
+	e.lock.Lock()
+	traces := e.traces
+	order := e.tracesOrder
+	e.traces = map[trace.TraceID][]*trace.SpanData{}
+	e.tracesOrder = nil
+	e.lock.Unlock()
+
+	for _, traceID := range order {
+		e.logTree(traceID, traces[traceID], false)
+	}
+}
+
+// removeTrace must be called with the lock held.
+func (e *ZapExporter) removeTrace(traceID trace.TraceID) []*trace.SpanData {
+	spans := e.traces[traceID]
+	delete(e.traces, traceID)
+
+	for i, candidate := range e.tracesOrder {
+		if candidate == traceID {
+			e.tracesOrder = append(e.tracesOrder[:i], e.tracesOrder[i+1:]...)
+			break
+		}
+	}
+
+	return spans
+}
+
+// markCompleted must be called with the lock held.
+func (e *ZapExporter) markCompleted(traceID trace.TraceID) {
+	if _, found := e.completed[traceID]; found {
+		return
+	}
+
+	if len(e.completedOrder) > 0 && len(e.completedOrder) >= e.maxBufferedTraces {
+		delete(e.completed, e.completedOrder[0])
+		e.completedOrder = e.completedOrder[1:]
+	}
+
+	e.completed[traceID] = struct{}{}
+	e.completedOrder = append(e.completedOrder, traceID)
+}
+
+func (e *ZapExporter) logSpan(span *trace.SpanData) {
+	if ce := e.logger.Check(e.spanLevel(span), "trace span"); ce != nil {
+		ce.Write(spanDataFields(span)...)
+	}
+}
+
+func (e *ZapExporter) logTree(traceID trace.TraceID, spans []*trace.SpanData, late bool) {
+	level := e.level
+	for _, span := range spans {
+		if spanLevel := e.spanLevel(span); spanLevel > level {
+			level = spanLevel
+		}
+	}
+
+	if ce := e.logger.Check(level, "trace"); ce != nil {
+		fields := []zap.Field{
+			zap.Stringer("trace_id", traceID),
+			zap.Int("span_count", len(spans)),
+			zap.String("tree", renderSpanTree(spans)),
+		}
+
+		if late {
+			fields = append(fields, zap.Bool("late", true))
+		}
+
+		ce.Write(fields...)
+	}
+}
+
+func (e *ZapExporter) spanLevel(span *trace.SpanData) zapcore.Level {
+	switch span.Code {
+	case trace.StatusCodeOK:
+		return e.level
+	case trace.StatusCodeUnknown, trace.StatusCodeDeadlineExceeded, trace.StatusCodeUnimplemented, trace.StatusCodeInternal, trace.StatusCodeUnavailable, trace.StatusCodeDataLoss:
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.WarnLevel
+	}
+}
+
+func (e *ZapExporter) ExportView(data *view.Data) {
+	elapsed := data.End.Sub(data.Start)
+
+	if ce := e.logger.Check(e.level, "view metrics data"); ce != nil {
+		ce.Write(
+			zap.Reflect("view", data.View),
+			zap.Reflect("rows", data.Rows),
+			zap.Duration("elapsed", elapsed),
+		)
+	}
+}
+
+func spanDataFields(span *trace.SpanData) []zap.Field {
+	fields := []zap.Field{
 		zap.String("name", span.Name),
+		zap.String("kind", spanKindName(span.SpanKind)),
 		zap.Stringer("trace_id", span.TraceID),
 		zap.Stringer("span_id", span.SpanID),
 		zap.Stringer("parent_span_id", span.ParentSpanID),
-		zap.Duration("elapsed", elapsed),
-		zap.Reflect("annotations", span.Annotations),
-	)
+		zap.Bool("has_remote_parent", span.HasRemoteParent),
+		zap.Bool("sampled", span.IsSampled()),
+		zap.Time("start_time", span.StartTime),
+		zap.Duration("elapsed", span.EndTime.Sub(span.StartTime)),
+		zap.Int32("status_code", span.Code),
+	}
+
+	if span.Message != "" {
+		fields = append(fields, zap.String("status_message", span.Message))
+	}
+
+	if len(span.Attributes) > 0 {
+		fields = append(fields, zap.Object("attributes", attributesMarshaler(span.Attributes)))
+	}
+
+	if len(span.Annotations) > 0 {
+		fields = append(fields, zap.Array("annotations", annotationsMarshaler(span.Annotations)))
+	}
+
+	if len(span.MessageEvents) > 0 {
+		fields = append(fields, zap.Array("message_events", messageEventsMarshaler(span.MessageEvents)))
+	}
+
+	if len(span.Links) > 0 {
+		fields = append(fields, zap.Array("links", linksMarshaler(span.Links)))
+	}
+
+	if span.ChildSpanCount > 0 {
+		fields = append(fields, zap.Int("child_span_count", span.ChildSpanCount))
+	}
+
+	for _, dropped := range []struct {
+		name  string
+		count int
+	}{
+		{"dropped_attributes_count", span.DroppedAttributeCount},
+		{"dropped_annotations_count", span.DroppedAnnotationCount},
+		{"dropped_message_events_count", span.DroppedMessageEventCount},
+		{"dropped_links_count", span.DroppedLinkCount},
+	} {
+		if dropped.count > 0 {
+			fields = append(fields, zap.Int(dropped.name, dropped.count))
+		}
+	}
+
+	return fields
 }
 
-func (exporter *zapExporter) ExportView(data *view.Data) {
-	elapsed := data.End.Sub(data.Start)
+func spanKindName(kind int) string {
+	switch kind {
+	case trace.SpanKindServer:
+		return "server"
+	case trace.SpanKindClient:
+		return "client"
+	default:
+		return "unspecified"
+	}
+}
+
+type attributesMarshaler map[string]interface{}
+
+func (m attributesMarshaler) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		zap.Any(key, m[key]).AddTo(encoder)
+	}
+
+	return nil
+}
+
+type annotationsMarshaler []trace.Annotation
+
+func (m annotationsMarshaler) MarshalLogArray(encoder zapcore.ArrayEncoder) error {
+	for _, annotation := range m {
+		annotation := annotation
+		encoder.AppendObject(zapcore.ObjectMarshalerFunc(func(encoder zapcore.ObjectEncoder) error {
+			encoder.AddTime("time", annotation.Time)
+			encoder.AddString("message", annotation.Message)
+			if len(annotation.Attributes) > 0 {
+				return encoder.AddObject("attributes", attributesMarshaler(annotation.Attributes))
+			}
+
+			return nil
+		}))
+	}
+
+	return nil
+}
+
+type messageEventsMarshaler []trace.MessageEvent
+
+func (m messageEventsMarshaler) MarshalLogArray(encoder zapcore.ArrayEncoder) error {
+	for _, event := range m {
+		event := event
+		encoder.AppendObject(zapcore.ObjectMarshalerFunc(func(encoder zapcore.ObjectEncoder) error {
+			encoder.AddTime("time", event.Time)
+			encoder.AddString("type", messageEventTypeName(event.EventType))
+			encoder.AddInt64("id", event.MessageID)
+			encoder.AddInt64("uncompressed_size", event.UncompressedByteSize)
+			encoder.AddInt64("compressed_size", event.CompressedByteSize)
+			return nil
+		}))
+	}
+
+	return nil
+}
+
+type linksMarshaler []trace.Link
+
+func (m linksMarshaler) MarshalLogArray(encoder zapcore.ArrayEncoder) error {
+	for _, link := range m {
+		link := link
+		encoder.AppendObject(zapcore.ObjectMarshalerFunc(func(encoder zapcore.ObjectEncoder) error {
+			encoder.AddString("trace_id", link.TraceID.String())
+			encoder.AddString("span_id", link.SpanID.String())
+			encoder.AddString("type", linkTypeName(link.Type))
+			if len(link.Attributes) > 0 {
+				return encoder.AddObject("attributes", attributesMarshaler(link.Attributes))
+			}
+
+			return nil
+		}))
+	}
+
+	return nil
+}
+
+func linkTypeName(linkType trace.LinkType) string {
+	switch linkType {
+	case trace.LinkTypeChild:
+		return "child"
+	case trace.LinkTypeParent:
+		return "parent"
+	default:
+		return "unspecified"
+	}
+}
+
+// renderSpanTree renders the spans as an indented tree ordered by start time, each line
+// being the span name, its start offset from the first span and its duration. Spans whose
+// parent is not part of `spans` are rendered at the top level.
+func renderSpanTree(spans []*trace.SpanData) string {
+	if len(spans) == 0 {
+		return ""
+	}
+
+	sorted := append([]*trace.SpanData(nil), spans...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].StartTime.Before(sorted[j].StartTime) })
+
+	present := make(map[trace.SpanID]bool, len(sorted))
+	children := make(map[trace.SpanID][]*trace.SpanData, len(sorted))
+	for _, span := range sorted {
+		present[span.SpanID] = true
+	}
+
+	var roots []*trace.SpanData
+	for _, span := range sorted {
+		if present[span.ParentSpanID] && span.ParentSpanID != span.SpanID {
+			children[span.ParentSpanID] = append(children[span.ParentSpanID], span)
+		} else {
+			roots = append(roots, span)
+		}
+	}
+
+	origin := sorted[0].StartTime
+	builder := &strings.Builder{}
+
+	var render func(span *trace.SpanData, depth int)
+	render = func(span *trace.SpanData, depth int) {
+		fmt.Fprintf(builder, "%s%s [+%s] %s", strings.Repeat("  ", depth), span.Name, span.StartTime.Sub(origin).Round(time.Microsecond), span.EndTime.Sub(span.StartTime).Round(time.Microsecond))
+		if span.Code != trace.StatusCodeOK {
+			fmt.Fprintf(builder, " (status %d: %s)", span.Code, span.Message)
+		}
+		builder.WriteString("\n")
+
+		for _, child := range children[span.SpanID] {
+			render(child, depth+1)
+		}
+	}
+
+	for _, root := range roots {
+		render(root, 0)
+	}
 
-	zlog.Debug("view metrics data",
-		zap.Reflect("view", data.View),
-		zap.Reflect("rows", data.Rows),
-		zap.Duration("elapsed", elapsed),
-	)
+	return strings.TrimSuffix(builder.String(), "\n")
 }
@@ -0,0 +1,126 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dtracing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestZapExporter(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	exporter := NewZapExporter(zap.New(core), WithZapExporterLevel(zapcore.InfoLevel))
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	exporter.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{TraceID: NewFixedTraceID("0000000000000000000000000000000a"), SpanID: trace.SpanID{1}},
+		Name:        "ok",
+		SpanKind:    trace.SpanKindServer,
+		StartTime:   start,
+		EndTime:     start.Add(time.Second),
+		Attributes:  map[string]interface{}{"key": "value"},
+		Annotations: []trace.Annotation{{Time: start, Message: "annotated"}},
+		Links:       []trace.Link{{TraceID: NewFixedTraceID("0000000000000000000000000000000b"), SpanID: trace.SpanID{2}, Type: trace.LinkTypeParent}},
+	})
+	exporter.ExportSpan(&trace.SpanData{Name: "not found", Status: trace.Status{Code: trace.StatusCodeNotFound, Message: "missing"}})
+	exporter.ExportSpan(&trace.SpanData{Name: "internal", Status: trace.Status{Code: trace.StatusCodeInternal}, DroppedAttributeCount: 2})
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, zapcore.InfoLevel, entries[0].Level)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "ok", fields["name"])
+	assert.Equal(t, "server", fields["kind"])
+	assert.Equal(t, time.Second, fields["elapsed"])
+	assert.Equal(t, map[string]interface{}{"key": "value"}, fields["attributes"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"time": start, "message": "annotated"}}, fields["annotations"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"trace_id": "0000000000000000000000000000000b",
+		"span_id":  "0200000000000000",
+		"type":     "parent",
+	}}, fields["links"])
+
+	assert.Equal(t, zapcore.WarnLevel, entries[1].Level)
+	assert.Equal(t, "missing", entries[1].ContextMap()["status_message"])
+
+	assert.Equal(t, zapcore.ErrorLevel, entries[2].Level)
+	assert.Equal(t, int64(2), entries[2].ContextMap()["dropped_attributes_count"])
+}
+
+func TestZapExporter_TreeMode(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	exporter := NewZapExporter(zap.New(core), WithZapExporterTreeMode(1))
+
+	traceID := NewFixedTraceID("0000000000000000000000000000000a")
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	span := func(name string, spanID, parentSpanID byte, offset, duration time.Duration) *trace.SpanData {
+		return &trace.SpanData{
+			SpanContext:  trace.SpanContext{TraceID: traceID, SpanID: trace.SpanID{spanID}},
+			ParentSpanID: trace.SpanID{parentSpanID},
+			Name:         name,
+			StartTime:    start.Add(offset),
+			EndTime:      start.Add(offset + duration),
+		}
+	}
+
+	exporter.ExportSpan(span("grand_child", 3, 2, 2*time.Millisecond, time.Millisecond))
+	exporter.ExportSpan(span("child", 2, 1, time.Millisecond, 5*time.Millisecond))
+	failing := span("failing", 4, 1, 7*time.Millisecond, time.Millisecond)
+	failing.Status = trace.Status{Code: trace.StatusCodeUnavailable, Message: "down"}
+	exporter.ExportSpan(failing)
+	assert.Equal(t, 0, logs.Len())
+
+	root := span("root", 1, 0, 0, 10*time.Millisecond)
+	root.ParentSpanID = trace.SpanID{}
+	exporter.ExportSpan(root)
+
+	entries := logs.TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, zapcore.ErrorLevel, entries[0].Level)
+	assert.Equal(t, int64(4), entries[0].ContextMap()["span_count"])
+	assert.Equal(t, "root [+0s] 10ms\n"+
+		"  child [+1ms] 5ms\n"+
+		"    grand_child [+2ms] 1ms\n"+
+		"  failing [+7ms] 1ms (status 14: down)", entries[0].ContextMap()["tree"])
+
+	// Spans ending after their local root are logged right away
+	exporter.ExportSpan(span("late", 7, 1, 11*time.Millisecond, time.Millisecond))
+	entries = logs.TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, true, entries[0].ContextMap()["late"])
+	assert.Equal(t, "late [+0s] 1ms", entries[0].ContextMap()["tree"])
+
+	// Limit of 1 buffered trace, the oldest one is logged when a second one is buffered
+	orphan := span("orphan", 5, 9, 0, time.Millisecond)
+	orphan.TraceID = NewFixedTraceID("0000000000000000000000000000000c")
+	exporter.ExportSpan(orphan)
+	other := span("other", 6, 9, 0, time.Millisecond)
+	other.TraceID = NewFixedTraceID("0000000000000000000000000000000b")
+	exporter.ExportSpan(other)
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t, "orphan [+0s] 1ms", logs.TakeAll()[0].ContextMap()["tree"])
+
+	exporter.Flush()
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t, "other [+0s] 1ms", logs.TakeAll()[0].ContextMap()["tree"])
+}